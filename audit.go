@@ -0,0 +1,123 @@
+package kktoken
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// the lifecycle events written to the audit table
+const (
+	// AuditCreate means a token is made.
+	AuditCreate = "create"
+	// AuditRevoke means a token is deleted by the caller.
+	AuditRevoke = "revoke"
+	// AuditExpire means a token is deleted by the DB EXPCheck, the reason is "idle" or "absolute".
+	AuditExpire = "expire"
+	// AuditSuspend means the tokens of a user are suspended.
+	AuditSuspend = "suspend"
+	// AuditResume means the tokens of a suspended user are accepted again.
+	AuditResume = "resume"
+)
+
+// AuditEvent a lifecycle event of tokens.
+type AuditEvent struct {
+	UserID int32
+	// the hex sha256 of the token, empty for user events like suspend
+	TokenHash string
+	Event     string
+	Reason    string
+	// provided by the caller
+	Meta map[string]interface{}
+	At   int32
+}
+
+var (
+	// ErrAudit means the operation is done, while error pop when writing the audit table.
+	ErrAudit = errors.New("audit not written")
+
+	dbAudit        bool
+	insertAuditStm string
+	queryAuditStm  string
+)
+
+// prepareAudit to create the audit table and statements.
+func prepareAudit(tableName string) error {
+	s := `CREATE TABLE IF NOT EXISTS %s_audit (
+	id BIGSERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	token_hash TEXT NOT NULL,
+	event TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	meta JSONB,
+	at INTEGER NOT NULL);`
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName)); err != nil {
+		return err
+	}
+
+	// create index if not exist to search events of a user by time
+	s = "CREATE INDEX IF NOT EXISTS %s_audit_user_id_at_index ON %s_audit USING btree (user_id, at);"
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName, tableName)); err != nil {
+		return err
+	}
+
+	insertAuditStm = fmt.Sprintf(`INSERT INTO %s_audit(user_id,token_hash,event,reason,meta,at)
+	SELECT u,h,$3,r,$5,$6 FROM unnest($1::integer[],$2::text[],$4::text[]) AS t(u,h,r)`, tableName)
+	queryAuditStm = fmt.Sprintf("SELECT user_id,token_hash,event,reason,meta,at FROM %s_audit WHERE user_id=$1 AND at>=$2 AND at<$3 ORDER BY id", tableName)
+	dbAudit = true
+	return nil
+}
+
+// addAudit to write the same event of tokens, the reasons can be a single one for all.
+// Nothing happens if audit is not enabled.
+func addAudit(db dbRunner, event string, userids []int32, tokens []string, reasons []string, meta map[string]interface{}) error {
+	if !dbAudit || len(userids) == 0 {
+		return nil
+	}
+
+	l := len(userids)
+	if l != len(tokens) || (len(reasons) != l && len(reasons) != 1) {
+		return errors.New("parameters wrong for audit batch add")
+	}
+
+	hashes := make([]string, l)
+	for i := range tokens {
+		if tokens[i] != "" {
+			hashes[i] = HashToken(tokens[i])
+		}
+	}
+	_, err := db.Exec(insertAuditStm, userids, hashes, event, fillStrings(reasons, l), meta, time.Now().Unix())
+	return err
+}
+
+// getAudit to get the events of a user in [from, to).
+func getAudit(userid int32, from, to int32) ([]AuditEvent, error) {
+	var events []AuditEvent
+	rows, _ := dbPool.Query(queryAuditStm, userid, from, to)
+	if err := rows.Err(); err != nil {
+		return events, err
+	}
+
+	for rows.Next() {
+		var one AuditEvent
+		if err := rows.Scan(&one.UserID, &one.TokenHash, &one.Event, &one.Reason, &one.Meta, &one.At); err != nil {
+			return events, err
+		}
+		events = append(events, one)
+	}
+	return events, rows.Err()
+}
+
+// GetAuditEvents to get the lifecycle events of a user between from (inclusive) and to (exclusive).
+// The audit table only exists when DBInfo.Audit is true.
+func GetAuditEvents(userid int32, from, to int32) ([]AuditEvent, error) {
+	if !dbAudit {
+		return nil, errors.New("audit not enabled")
+	}
+	return getAudit(userid, from, to)
+}
+
+// HashToken to get the token hash in audit events.
+func HashToken(token string) string {
+	return hashValue(cleanToken(token))
+}
@@ -0,0 +1,102 @@
+package kktoken
+
+import (
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAudit(t *testing.T) {
+	_, err := GetAuditEvents(1, 0, 0)
+	assert.Error(t, err, "should have error when audit not enabled")
+
+	err = prepareAudit(testTableName)
+	assert.NoError(t, err, "should not have error to prepare audit")
+	defer func() {
+		dbAudit = false
+	}()
+	testTableGeneration(testTableName+"_audit", t)
+
+	userid := int32(32)
+	from := int32(time.Now().Unix())
+	tk, err := MakeTokenWithOptions(userid, nil, &TokenOptions{Reason: "login", Meta: map[string]interface{}{"ip": "10.0.0.1"}})
+	assert.NoError(t, err, "should not have error to make token")
+	child, err := MakeChildToken(tk, nil, nil)
+	assert.NoError(t, err, "should not have error to make child token")
+
+	err = RevokeToken(tk, "password_changed", map[string]interface{}{"admin": "bob"})
+	assert.NoError(t, err, "should not have error to revoke token")
+
+	err = SuspendUserWithReason(userid, "fraud_review", map[string]interface{}{"admin": "bob"})
+	assert.NoError(t, err, "should not have error to suspend user")
+	err = ResumeUserWithReason(userid, "review_cleared", map[string]interface{}{"admin": "alice"})
+	assert.NoError(t, err, "should not have error to resume user")
+
+	// expire by EXPCheck
+	now := time.Now().Unix()
+	tkInfo := &TokenInfo{
+		Token:    uuid.NewV4().String(),
+		UserID:   userid,
+		CreateAt: int32(now),
+		LastUse:  int32(now),
+		ExpireAt: int32(now),
+	}
+	err = setToken(tkInfo)
+	assert.NoError(t, err, "should not have error to set token")
+	// the child not expired itself is deleted with its parent
+	childInfo := &TokenInfo{
+		Token:    uuid.NewV4().String(),
+		UserID:   userid,
+		CreateAt: int32(now),
+		LastUse:  int32(now),
+		Parent:   tkInfo.Token,
+	}
+	err = setToken(childInfo)
+	assert.NoError(t, err, "should not have error to set token")
+	child2 := cleanToken(childInfo.Token)
+	setToMap(child2, tokenLatest{userid: userid})
+	err = setRedisCache([]string{child2}, []tokenLatest{{userid: userid}})
+	assert.NoError(t, err, "should not have error to set cache")
+	_, err = delExpired(dbPool, delExpiredSQL(testTableName), 0, now)
+	assert.NoError(t, err, "should not have error to delete expired tokens")
+	_, ok := peekMap(child2)
+	assert.False(t, ok, "child should be evicted from map")
+	got, err := getRedisCache(child2)
+	assert.NoError(t, err, "should not have error to get from cache")
+	assert.Equal(t, int32(0), got.userid, "child should be deleted from Redis")
+
+	events, err := GetAuditEvents(userid, from, int32(time.Now().Unix())+1)
+	assert.NoError(t, err, "should not have error to get audit events")
+	if assert.Len(t, events, 8, "should have 8 events") {
+		assert.Equal(t, AuditCreate, events[0].Event, "event wrong")
+		assert.Equal(t, HashToken(tk), events[0].TokenHash, "token hash wrong")
+		assert.Equal(t, "login", events[0].Reason, "reason wrong")
+		assert.Equal(t, "10.0.0.1", events[0].Meta["ip"], "meta wrong")
+		assert.Equal(t, AuditCreate, events[1].Event, "event wrong")
+		assert.Equal(t, HashToken(child), events[1].TokenHash, "token hash wrong")
+		assert.Equal(t, AuditRevoke, events[2].Event, "event wrong")
+		assert.Equal(t, "password_changed", events[2].Reason, "reason wrong")
+		assert.Equal(t, "bob", events[2].Meta["admin"], "meta wrong")
+		assert.Equal(t, AuditRevoke, events[3].Event, "child should be revoked")
+		assert.Equal(t, AuditSuspend, events[4].Event, "event wrong")
+		assert.Equal(t, "", events[4].TokenHash, "suspend should not have token")
+		assert.Equal(t, "fraud_review", events[4].Reason, "reason wrong")
+		assert.Equal(t, "bob", events[4].Meta["admin"], "meta wrong")
+		assert.Equal(t, AuditResume, events[5].Event, "event wrong")
+		assert.Equal(t, "review_cleared", events[5].Reason, "reason wrong")
+		assert.Equal(t, "alice", events[5].Meta["admin"], "meta wrong")
+		assert.Equal(t, AuditExpire, events[6].Event, "event wrong")
+		assert.Equal(t, "absolute", events[6].Reason, "expire reason wrong")
+		assert.Equal(t, HashToken(tkInfo.Token), events[6].TokenHash, "token hash wrong")
+		assert.Equal(t, AuditRevoke, events[7].Event, "child should be revoked")
+		assert.Equal(t, "parent", events[7].Reason, "child reason wrong")
+		assert.Equal(t, HashToken(childInfo.Token), events[7].TokenHash, "token hash wrong")
+	}
+
+	// out of range
+	events, err = GetAuditEvents(userid, 0, from)
+	assert.NoError(t, err, "should not have error to get audit events")
+	assert.Len(t, events, 0, "should have no events")
+}
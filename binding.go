@@ -0,0 +1,144 @@
+package kktoken
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Client the information of the client using a token.
+type Client struct {
+	IP          net.IP
+	UserAgent   string
+	Fingerprint string
+	// The identity of the caller like an API client, used with IP to limit failed lookups.
+	ID string
+}
+
+// Binding to tie a token to its client, empty fields will not be checked.
+type Binding struct {
+	// The allowed client IP range like "10.0.0.0/8", a single IP is also accepted.
+	CIDR string
+	// The user agent of the client, only its hash will be stored.
+	UserAgent string
+	// A fingerprint provided by the caller, only its hash will be stored.
+	Fingerprint string
+	// Only send EventBindingMismatch to the observer without rejecting the token.
+	ReportOnly bool
+}
+
+// BindingError means the client doesn't match the binding of the token.
+type BindingError struct {
+	Token  string
+	UserID int32
+	// the mismatched field: "ip", "user_agent" or "fingerprint"
+	Field string
+}
+
+func (e *BindingError) Error() string {
+	return fmt.Sprintf("token binding mismatch on %s", e.Field)
+}
+
+// the binding stored in DB and cache
+type clientBinding struct {
+	CIDR        string `json:"c,omitempty"`
+	UserAgent   string `json:"a,omitempty"`
+	Fingerprint string `json:"f,omitempty"`
+	ReportOnly  bool   `json:"r,omitempty"`
+}
+
+// hashValue to get the hex sha256 of a value.
+func hashValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseCIDR to parse a CIDR or a single IP.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid binding IP: %s", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+// newClientBinding to get the stored form of a binding, nil if nothing to bind.
+func newClientBinding(b *Binding) (*clientBinding, error) {
+	if b == nil || (b.CIDR == "" && b.UserAgent == "" && b.Fingerprint == "") {
+		return nil, nil
+	}
+
+	one := &clientBinding{ReportOnly: b.ReportOnly}
+	if b.CIDR != "" {
+		ipNet, err := parseCIDR(b.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		one.CIDR = ipNet.String()
+	}
+	if b.UserAgent != "" {
+		one.UserAgent = hashValue(b.UserAgent)
+	}
+	if b.Fingerprint != "" {
+		one.Fingerprint = hashValue(b.Fingerprint)
+	}
+	return one, nil
+}
+
+// mismatch to get the first field the client doesn't match, empty if matched.
+// A nil client matches nothing.
+func (b *clientBinding) mismatch(c *Client) string {
+	if b.CIDR != "" {
+		ipNet, err := parseCIDR(b.CIDR)
+		if err != nil || c == nil || c.IP == nil || !ipNet.Contains(c.IP) {
+			return "ip"
+		}
+	}
+	if b.UserAgent != "" && (c == nil || hashValue(c.UserAgent) != b.UserAgent) {
+		return "user_agent"
+	}
+	if b.Fingerprint != "" && (c == nil || hashValue(c.Fingerprint) != b.Fingerprint) {
+		return "fingerprint"
+	}
+	return ""
+}
+
+// checkBinding to verify the client against the binding of a token.
+// Return error only when the binding is not report only.
+func checkBinding(token string, one tokenLatest, c *Client) error {
+	if one.binding == nil {
+		return nil
+	}
+
+	field := one.binding.mismatch(c)
+	if field == "" {
+		return nil
+	}
+
+	emit(Event{
+		Kind:   EventBindingMismatch,
+		Token:  token,
+		UserID: one.userid,
+		Detail: field,
+	})
+	if one.binding.ReportOnly {
+		return nil
+	}
+	return &BindingError{
+		Token:  token,
+		UserID: one.userid,
+		Field:  field,
+	}
+}
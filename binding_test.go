@@ -0,0 +1,102 @@
+package kktoken
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testBindingMismatch(t *testing.T) {
+	_, err := newClientBinding(&Binding{CIDR: "abc"})
+	assert.Error(t, err, "should have error with invalid CIDR")
+
+	b, err := newClientBinding(&Binding{})
+	assert.NoError(t, err, "should not have error with empty binding")
+	assert.Nil(t, b, "empty binding should be nil")
+
+	b, err = newClientBinding(&Binding{CIDR: "10.0.0.1", UserAgent: "ua", Fingerprint: "fp"})
+	assert.NoError(t, err, "should not have error to make binding")
+	assert.Equal(t, "10.0.0.1/32", b.CIDR, "single IP should be a /32")
+	assert.NotEqual(t, "ua", b.UserAgent, "user agent should be hashed")
+
+	client := &Client{IP: net.ParseIP("10.0.0.1"), UserAgent: "ua", Fingerprint: "fp"}
+	assert.Equal(t, "", b.mismatch(client), "client should match")
+	assert.Equal(t, "ip", b.mismatch(nil), "nil client should not match")
+
+	client.IP = net.ParseIP("10.0.0.2")
+	assert.Equal(t, "ip", b.mismatch(client), "ip should not match")
+
+	client.IP = net.ParseIP("10.0.0.1")
+	client.UserAgent = "other"
+	assert.Equal(t, "user_agent", b.mismatch(client), "user agent should not match")
+
+	client.UserAgent = "ua"
+	client.Fingerprint = "other"
+	assert.Equal(t, "fingerprint", b.mismatch(client), "fingerprint should not match")
+}
+
+func testBindingTokens(t *testing.T) {
+	var events []Event
+	SetObserver(func(e Event) {
+		events = append(events, e)
+	})
+	defer SetObserver(nil)
+
+	userid := int32(13)
+	tk, err := MakeTokenWithOptions(userid, nil, &TokenOptions{Binding: &Binding{CIDR: "192.168.1.0/24", UserAgent: "ua"}})
+	assert.NoError(t, err, "should not have error to make token")
+
+	client := &Client{IP: net.ParseIP("192.168.1.20"), UserAgent: "ua"}
+	gotUserID, err := GetClientUserID(tk, client)
+	assert.NoError(t, err, "should not have error with matched client")
+	assert.Equal(t, userid, gotUserID, "userid wrong")
+
+	// mismatch from Redis
+	evictMap([]string{tk})
+	gotUserID, err = GetClientUserID(tk, &Client{IP: net.ParseIP("192.168.2.20"), UserAgent: "ua"})
+	assert.IsType(t, &BindingError{}, err, "should have binding error")
+	assert.Equal(t, "ip", err.(*BindingError).Field, "mismatched field wrong")
+	assert.Equal(t, int32(0), gotUserID, "userid should be 0 when mismatch")
+
+	// without client is a mismatch
+	_, err = GetUserID(tk)
+	assert.IsType(t, &BindingError{}, err, "should have binding error")
+	assert.Len(t, events, 2, "should have 2 events")
+	assert.Equal(t, EventBindingMismatch, events[0].Kind, "event kind wrong")
+	assert.Equal(t, userid, events[0].UserID, "event userid wrong")
+
+	// report only binding from DB
+	tk2, err := MakeTokenWithOptions(userid, nil, &TokenOptions{Binding: &Binding{Fingerprint: "fp", ReportOnly: true}})
+	assert.NoError(t, err, "should not have error to make token")
+	evictMap([]string{tk2})
+	err = delRedisCache(tk2)
+	assert.NoError(t, err, "should not have error to delete from Redis")
+
+	gotUserID, err = GetClientUserID(tk2, &Client{Fingerprint: "other"})
+	assert.NoError(t, err, "should not have error with report only binding")
+	assert.Equal(t, userid, gotUserID, "userid wrong")
+	assert.Len(t, events, 3, "should have 3 events")
+	assert.Equal(t, "fingerprint", events[2].Detail, "event detail wrong")
+
+	// the scope is checked with the binding
+	ok, err := HasClientScope(tk, "orders:read", client)
+	assert.NoError(t, err, "should not have error with matched client")
+	assert.False(t, ok, "should not have the scope")
+	_, err = HasClientScope(tk, "orders:read", &Client{IP: net.ParseIP("192.168.2.20"), UserAgent: "ua"})
+	assert.IsType(t, &BindingError{}, err, "should have binding error")
+
+	// the child is bound to the same client
+	child, err := MakeChildToken(tk, nil, &TokenOptions{Binding: &Binding{Fingerprint: "fp"}})
+	assert.NoError(t, err, "should not have error to make child token")
+	gotUserID, err = GetClientUserID(child, client)
+	assert.NoError(t, err, "should not have error with matched client")
+	assert.Equal(t, userid, gotUserID, "userid wrong")
+	_, err = GetClientUserID(child, &Client{IP: net.ParseIP("192.168.2.20"), UserAgent: "ua"})
+	assert.IsType(t, &BindingError{}, err, "child should have binding error")
+
+	err = DelToken(tk)
+	assert.NoError(t, err, "should not have error to delete with public method")
+	err = DelToken(tk2)
+	assert.NoError(t, err, "should not have error to delete with public method")
+}
@@ -0,0 +1,211 @@
+package kktoken
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// a Bloom filter of tokens
+type bloomFilter struct {
+	bits []uint64
+	k    uint64
+}
+
+// the filter of all tokens in DB, rebuilt from time to time to drop the deleted ones
+type bloomStore struct {
+	filter *bloomFilter
+	// the bus generation when the filter started building
+	gen int64
+	// the tokens added while rebuilding, nil if not rebuilding
+	pending []string
+	lock    *sync.RWMutex
+}
+
+var (
+	// How many tokens the filter is sized for at least, 0 means disabled
+	mapBloomCapacity uint32
+	// The false positive rate of the filter
+	mapBloomFPRate = 0.01
+	// How many seconds to rebuild the filter
+	mapBloomRebuildSecond = uint32(3600)
+
+	allBloom = bloomStore{
+		lock: new(sync.RWMutex),
+	}
+	// to rebuild the filter at once
+	bloomRebuild = make(chan struct{}, 1)
+)
+
+// newBloomFilter to make a filter for n tokens with the false positive rate p.
+func newBloomFilter(n uint32, p float64) *bloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Ceil(float64(m) / float64(n) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		k:    k,
+	}
+}
+
+// locations to get the k bit locations of a token by double hashing.
+func (f *bloomFilter) locations(tk string) []uint64 {
+	h1 := fnv.New64a()
+	h1.Write([]byte(tk))
+	h2 := fnv.New64()
+	h2.Write([]byte(tk))
+	a, b := h1.Sum64(), h2.Sum64()|1
+
+	m := uint64(len(f.bits)) * 64
+	locs := make([]uint64, f.k)
+	for i := uint64(0); i < f.k; i++ {
+		locs[i] = (a + i*b) % m
+	}
+	return locs
+}
+
+func (f *bloomFilter) add(tk string) {
+	for _, loc := range f.locations(tk) {
+		f.bits[loc/64] |= 1 << (loc % 64)
+	}
+}
+
+// test to check whether the token might be added, false means definitely not.
+func (f *bloomFilter) test(tk string) bool {
+	for _, loc := range f.locations(tk) {
+		if f.bits[loc/64]&(1<<(loc%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// prepareBloom to check the settings and build the filter.
+func prepareBloom() error {
+	if rdsChannel == "" && dbNotifyChannel == "" {
+		return errors.New("bloom filter needs RDSInfo.Channel or DBInfo.NotifyChannel to know the tokens made by other processes")
+	}
+	if mapBloomFPRate <= 0 || mapBloomFPRate >= 1 {
+		return errors.New("bloom false positive rate should be between 0 and 1")
+	}
+	return rebuildBloom()
+}
+
+// bloomAdd to add the tokens made to the filter.
+func bloomAdd(tokens ...string) {
+	allBloom.lock.Lock()
+	defer allBloom.lock.Unlock()
+	if allBloom.filter == nil {
+		return
+	}
+	for _, tk := range tokens {
+		allBloom.filter.add(tk)
+	}
+	if allBloom.pending != nil {
+		allBloom.pending = append(allBloom.pending, tokens...)
+	}
+}
+
+// bloomReject to check whether the token definitely doesn't exist in DB, unless it's just made by other processes.
+// The filter is not used while the bus is down, or until it's rebuilt after the bus is up,
+// because the tokens made by other processes might be missed.
+func bloomReject(tk string) bool {
+	if mapBloomCapacity == 0 || busDown() {
+		return false
+	}
+
+	allBloom.lock.RLock()
+	defer allBloom.lock.RUnlock()
+	if allBloom.filter == nil || allBloom.gen != busGeneration() {
+		return false
+	}
+	return !allBloom.filter.test(cleanToken(tk))
+}
+
+// requestBloomRebuild to rebuild the filter at once if enabled.
+func requestBloomRebuild() {
+	if mapBloomCapacity == 0 {
+		return
+	}
+	select {
+	case bloomRebuild <- struct{}{}:
+	default:
+	}
+}
+
+// rebuildBloom to build a new filter with all tokens in DB.
+func rebuildBloom() error {
+	allBloom.lock.Lock()
+	allBloom.pending = []string{}
+	gen := busGeneration()
+	allBloom.lock.Unlock()
+
+	f, err := loadBloom()
+	allBloom.lock.Lock()
+	defer allBloom.lock.Unlock()
+	if err != nil {
+		allBloom.pending = nil
+		return err
+	}
+
+	// the tokens made while loading
+	for _, tk := range allBloom.pending {
+		f.add(tk)
+	}
+	allBloom.filter = f
+	allBloom.gen = gen
+	allBloom.pending = nil
+	return nil
+}
+
+// loadBloom to make a filter of all tokens in DB.
+func loadBloom() (*bloomFilter, error) {
+	var count uint32
+	if err := dbPool.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", dbTableName)).Scan(&count); err != nil {
+		return nil, err
+	}
+	if count < mapBloomCapacity {
+		count = mapBloomCapacity
+	}
+	f := newBloomFilter(count, mapBloomFPRate)
+
+	rows, _ := dbPool.Query(fmt.Sprintf("SELECT token::text FROM %s", dbTableName))
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var tk string
+		if err := rows.Scan(&tk); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		f.add(cleanToken(tk))
+	}
+	return f, rows.Err()
+}
+
+// startBloomRebuild to rebuild the filter every given seconds, or when requested.
+func startBloomRebuild(seconds uint32) {
+	c := time.NewTicker(time.Duration(seconds) * time.Second)
+	defer c.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-c.C:
+		case <-bloomRebuild:
+		}
+
+		if err := rebuildBloom(); err != nil {
+			sendError(err)
+		}
+	}
+}
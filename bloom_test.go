@@ -0,0 +1,83 @@
+package kktoken
+
+import (
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func testBloomFilter(t *testing.T) {
+	f := newBloomFilter(1000, 0.01)
+	var tokens []string
+	for i := 0; i < 1000; i++ {
+		tk := cleanToken(uuid.NewV4().String())
+		f.add(tk)
+		tokens = append(tokens, tk)
+	}
+	for _, tk := range tokens {
+		assert.True(t, f.test(tk), "added token should be found")
+	}
+
+	positive := 0
+	for i := 0; i < 10000; i++ {
+		if f.test(cleanToken(uuid.NewV4().String())) {
+			positive++
+		}
+	}
+	assert.True(t, positive < 300, "false positive rate should be about 0.01")
+}
+
+func testBloomReject(t *testing.T) {
+	mapBloomCapacity = 100
+	defer func() {
+		mapBloomCapacity = 0
+		allBloom.lock.Lock()
+		allBloom.filter = nil
+		allBloom.lock.Unlock()
+	}()
+
+	userid := int32(37)
+	made, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+	assert.NoError(t, rebuildBloom(), "should not have error to rebuild")
+	assert.False(t, bloomReject(made), "token in DB should not be rejected")
+
+	tk, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+	assert.False(t, bloomReject(tk), "token made should not be rejected")
+	other := cleanToken(uuid.NewV4().String())
+	assert.NoError(t, handleBusMessage(busCreate+" "+other), "should not have error to handle message")
+	assert.False(t, bloomReject(other), "token made by another process should not be rejected")
+
+	unknown := cleanToken(uuid.NewV4().String())
+	assert.True(t, bloomReject(unknown), "unknown token should be rejected")
+	gotUserID, err := GetUserID(unknown)
+	assert.NoError(t, err, "should not have error to get unknown token")
+	assert.Equal(t, int32(0), gotUserID, "userid should be 0")
+
+	// made by another process, but not told yet
+	notTold := cleanToken(uuid.NewV4().String())
+	err = setRedisCache([]string{notTold}, []tokenLatest{{userid: userid}})
+	assert.NoError(t, err, "should not have error to set cache")
+	assert.True(t, bloomReject(notTold), "token not told should not be in the filter")
+	gotUserID, err = GetUserID(notTold)
+	assert.NoError(t, err, "should not have error to get token from Redis")
+	assert.Equal(t, userid, gotUserID, "token in Redis should not be rejected")
+	evictMap([]string{notTold})
+	assert.NoError(t, delRedisCache(notTold), "should not have error to delete cache")
+
+	// not used while the bus is down, until rebuilt after up
+	enableBus("test")
+	assert.False(t, bloomReject(unknown), "should not reject while bus down")
+	setBusUp("test", true)
+	assert.False(t, bloomReject(unknown), "should not reject before rebuilt")
+	assert.NoError(t, rebuildBloom(), "should not have error to rebuild")
+	assert.True(t, bloomReject(unknown), "should reject after rebuilt")
+	busLock.Lock()
+	delete(busStates, "test")
+	busLock.Unlock()
+
+	assert.NoError(t, DelToken(made), "should not have error to delete token")
+	assert.NoError(t, DelToken(tk), "should not have error to delete token")
+}
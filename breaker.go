@@ -0,0 +1,97 @@
+package kktoken
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker to stop using a tier after it fails too many times in a row, until a probe succeeds.
+type circuitBreaker struct {
+	// the tier, sent as the Detail of events
+	name string
+	// how many failures in a row to open
+	threshold uint32
+	// how many seconds between probes while open
+	probeSecond uint32
+	// to check whether the tier is back
+	probe func() error
+	// called after closed again
+	onClose func()
+
+	failures uint32
+	open     bool
+	lock     *sync.Mutex
+}
+
+func newCircuitBreaker(name string, probe func() error, onClose func()) *circuitBreaker {
+	return &circuitBreaker{
+		name:        name,
+		threshold:   5,
+		probeSecond: 5,
+		probe:       probe,
+		onClose:     onClose,
+		lock:        new(sync.Mutex),
+	}
+}
+
+// allow to check whether the tier can be used.
+func (b *circuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return !b.open
+}
+
+// report the result of using the tier, the failures are counted.
+func (b *circuitBreaker) report(failed bool) {
+	b.lock.Lock()
+	if !failed {
+		b.failures = 0
+		b.lock.Unlock()
+		return
+	}
+
+	b.failures++
+	if b.open || b.failures < b.threshold {
+		b.lock.Unlock()
+		return
+	}
+	b.open = true
+	b.lock.Unlock()
+
+	emit(Event{
+		Kind:   EventBreakerOpen,
+		Detail: b.name,
+	})
+	goWorker(b.startProbe)
+}
+
+// startProbe to probe the tier every probeSecond until it's back.
+func (b *circuitBreaker) startProbe() {
+	c := time.NewTicker(time.Duration(b.probeSecond) * time.Second)
+	defer c.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-c.C:
+		}
+
+		if b.probe() != nil {
+			continue
+		}
+
+		b.lock.Lock()
+		b.open = false
+		b.failures = 0
+		b.lock.Unlock()
+
+		if b.onClose != nil {
+			b.onClose()
+		}
+		emit(Event{
+			Kind:   EventBreakerClose,
+			Detail: b.name,
+		})
+		return
+	}
+}
@@ -0,0 +1,102 @@
+package kktoken
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCircuitBreaker(t *testing.T) {
+	var kinds []EventKind
+	var lock sync.Mutex
+	SetObserver(func(e Event) {
+		if e.Detail == "test" {
+			lock.Lock()
+			kinds = append(kinds, e.Kind)
+			lock.Unlock()
+		}
+	})
+	defer SetObserver(nil)
+
+	var down int32 = 1
+	var closed int32
+	b := newCircuitBreaker("test", func() error {
+		if atomic.LoadInt32(&down) == 1 {
+			return errors.New("down")
+		}
+		return nil
+	}, func() {
+		atomic.StoreInt32(&closed, 1)
+	})
+	b.threshold = 2
+	b.probeSecond = 1
+
+	b.report(true)
+	b.report(false)
+	b.report(true)
+	assert.True(t, b.allow(), "failures not in a row should not open")
+	b.report(true)
+	assert.False(t, b.allow(), "should open after failures in a row")
+
+	time.Sleep(1100 * time.Millisecond)
+	assert.False(t, b.allow(), "should keep open while probe fails")
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(1100 * time.Millisecond)
+	assert.True(t, b.allow(), "should close after probe succeeds")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&closed), "onClose should be called")
+
+	lock.Lock()
+	assert.Equal(t, []EventKind{EventBreakerOpen, EventBreakerClose}, kinds, "events wrong")
+	lock.Unlock()
+}
+
+func testRedisBreaker(t *testing.T) {
+	userid := int32(39)
+	tk, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+
+	// Redis is skipped
+	rdsBreaker.lock.Lock()
+	rdsBreaker.open = true
+	rdsBreaker.lock.Unlock()
+
+	evictMap([]string{tk})
+	gotUserID, err := GetUserID(tk)
+	assert.NoError(t, err, "should get from DB without error")
+	assert.Equal(t, userid, gotUserID, "userid wrong")
+
+	tk2, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should make token without error")
+	_, err = getRedisCache(tk2)
+	assert.Equal(t, errRedisOpen, err, "redis should be skipped")
+
+	err = DelToken(tk)
+	assert.NoError(t, err, "should delete token without error")
+
+	// Redis is back
+	rdsBreaker.lock.Lock()
+	rdsBreaker.open = false
+	rdsBreaker.lock.Unlock()
+	redisBack()
+
+	got, err := getRedisCache(tk)
+	assert.NoError(t, err, "should not have error to get from redis")
+	assert.Equal(t, int32(0), got.userid, "deleted token should be deleted from redis when back")
+	pending, dropped := rdsPending.take()
+	assert.Len(t, pending, 0, "no token should be pending")
+	assert.Equal(t, 0, dropped, "no token should be dropped")
+
+	// the oldest are dropped when full
+	rdsPending.limit = 2
+	rdsPending.add("a", "b")
+	rdsPending.add("c")
+	pending, dropped = rdsPending.take()
+	assert.Equal(t, []string{"b", "c"}, pending, "pending tokens wrong")
+	assert.Equal(t, 1, dropped, "dropped count wrong")
+	rdsPending.limit = 10000
+	assert.NoError(t, DelToken(tk2), "should not have error to delete token")
+}
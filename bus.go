@@ -0,0 +1,182 @@
+package kktoken
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the kinds of invalidation messages between processes
+const (
+	busRevoke  = "revoke"
+	busSuspend = "suspend"
+	busResume  = "resume"
+	busUpdate  = "update"
+	busCreate  = "create"
+	busUnlock  = "unlock"
+)
+
+// how many values at most in one message, keeping a message of tokens less than 8000 bytes for NOTIFY
+const busChunkSize = 100
+
+// the names of the buses
+const (
+	busRedis    = "redis"
+	busPostgres = "postgres"
+)
+
+var (
+	// How many seconds a token can live in map while the bus is down
+	mapDownLiveSecond = uint32(5)
+
+	busLock = new(sync.RWMutex)
+	// the state of each enabled bus, true means up
+	busStates = make(map[string]bool)
+	// the tokens loaded to map before it might have missed messages
+	mapValidAfter int64
+	// how many times a bus is up
+	busUps int64
+)
+
+// enableBus to register a bus, it's down until setBusUp.
+func enableBus(name string) {
+	busLock.Lock()
+	busStates[name] = false
+	busLock.Unlock()
+}
+
+// setBusUp to change the state of a bus and send the event when changed.
+func setBusUp(name string, up bool) {
+	busLock.Lock()
+	old, ok := busStates[name]
+	busStates[name] = up
+	busLock.Unlock()
+
+	if ok && old == up {
+		return
+	}
+	kind := EventBusDown
+	if up {
+		// the messages sent while down are lost, check the tokens again
+		atomic.StoreInt64(&mapValidAfter, time.Now().Unix())
+		atomic.AddInt64(&busUps, 1)
+		requestBloomRebuild()
+		kind = EventBusUp
+	}
+	emit(Event{
+		Kind:   kind,
+		Detail: name,
+	})
+}
+
+// busDown to check whether any enabled bus is down, messages might be missed.
+func busDown() bool {
+	busLock.RLock()
+	defer busLock.RUnlock()
+	for _, up := range busStates {
+		if !up {
+			return true
+		}
+	}
+	return false
+}
+
+// busGeneration to get how many times a bus is up, the messages before might be missed.
+func busGeneration() int64 {
+	return atomic.LoadInt64(&busUps)
+}
+
+// mapStale to check whether a token loaded to map at the time should be checked again,
+// because the revocation might not be received.
+func mapStale(loadAt int32) bool {
+	if int64(loadAt) < atomic.LoadInt64(&mapValidAfter) {
+		return true
+	}
+	// the age first, busDown takes a lock shared by all lookups
+	return time.Now().Unix()-int64(loadAt) >= int64(mapDownLiveSecond) && busDown()
+}
+
+// busMessages to encode the values of a kind into messages.
+func busMessages(kind string, values []string) []string {
+	var msgs []string
+	for i := 0; i < len(values); i += busChunkSize {
+		end := i + busChunkSize
+		if end > len(values) {
+			end = len(values)
+		}
+		msgs = append(msgs, kind+" "+strings.Join(values[i:end], " "))
+	}
+	return msgs
+}
+
+// publish to send the values of a kind to other processes through all enabled buses.
+func publish(kind string, values ...string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	msgs := busMessages(kind, values)
+
+	var err error
+	if rdsChannel != "" {
+		if e := skipOpen(publishRedis(msgs)); e != nil {
+			err = e
+		}
+	}
+	if dbNotifyChannel != "" {
+		if e := publishDB(msgs); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// publishUser to send a user message to other processes.
+func publishUser(kind string, userid int32) error {
+	return publish(kind, strconv.FormatInt(int64(userid), 10))
+}
+
+// handleBusMessage to apply a message from other processes to this process.
+func handleBusMessage(msg string) error {
+	fields := strings.Fields(msg)
+	if len(fields) < 2 {
+		return nil
+	}
+
+	switch fields[0] {
+	case busRevoke, busUpdate:
+		evictMap(fields[1:])
+		// the pending refresh would cache it again
+		rdsRetry.drop(fields[1:])
+		if fields[0] == busRevoke {
+			dbRetry.drop(fields[1:])
+		}
+		// the token might be cached again by a process reading DB before it's changed
+		if err := delRedisCache(fields[1:]...); err == errRedisOpen {
+			rdsPending.add(fields[1:]...)
+		} else if err != nil {
+			return err
+		}
+	case busUnlock:
+		allLocks.forget(fields[1:])
+	case busCreate:
+		forgetMissing(fields[1:])
+		bloomAdd(fields[1:]...)
+	case busSuspend, busResume:
+		allSuspended.lock.Lock()
+		for _, one := range fields[1:] {
+			userid, err := strconv.ParseInt(one, 10, 32)
+			if err != nil {
+				continue
+			}
+			if fields[0] == busSuspend {
+				allSuspended.all[int32(userid)] = true
+			} else {
+				delete(allSuspended.all, int32(userid))
+			}
+		}
+		allSuspended.lock.Unlock()
+	}
+	return nil
+}
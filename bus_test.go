@@ -0,0 +1,108 @@
+package kktoken
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testBusMessages(t *testing.T) {
+	var tokens []string
+	for i := 0; i < busChunkSize+1; i++ {
+		tokens = append(tokens, fmt.Sprintf("tk%d", i))
+	}
+	msgs := busMessages(busRevoke, tokens)
+	assert.Len(t, msgs, 2, "messages should be chunked")
+	assert.Equal(t, busRevoke+" tk100", msgs[1], "message wrong")
+
+	setToMap("tk1", tokenLatest{userid: 1})
+	setToMap("tk2", tokenLatest{userid: 1})
+	assert.NoError(t, handleBusMessage(busRevoke+" tk1 tk2"), "should not have error when handling message")
+	assert.Equal(t, int32(0), getAndSetMap("tk1", nil).userid, "token should be evicted")
+	assert.Equal(t, int32(0), getAndSetMap("tk2", nil).userid, "token should be evicted")
+
+	userid := int32(55)
+	assert.NoError(t, handleBusMessage(fmt.Sprintf("%s %d", busSuspend, userid)), "should not have error when handling message")
+	assert.True(t, isSuspended(userid), "user should be suspended")
+	assert.NoError(t, handleBusMessage(fmt.Sprintf("%s %d", busResume, userid)), "should not have error when handling message")
+	assert.False(t, isSuspended(userid), "user should be resumed")
+
+	// wrong messages are ignored
+	handleBusMessage(busSuspend)
+	handleBusMessage(busSuspend + " abc")
+	handleBusMessage("unknown tk")
+}
+
+func testRedisBus(t *testing.T) {
+	var kinds []EventKind
+	var lock sync.Mutex
+	SetObserver(func(e Event) {
+		if e.Detail == busRedis {
+			lock.Lock()
+			kinds = append(kinds, e.Kind)
+			lock.Unlock()
+		}
+	})
+	defer SetObserver(nil)
+
+	rdsChannel = testTableName
+	enableBus(busRedis)
+	goWorker(func() {
+		startRedisSubscribe(rdsChannel)
+	})
+
+	// the map is short lived before subscribed
+	tk := "abc"
+	setToMap(tk, tokenLatest{userid: 3})
+	shard := allTokens.shard(tk)
+	shard.lock.Lock()
+	shard.all[tk].loadAt -= int32(mapDownLiveSecond)
+	shard.lock.Unlock()
+	assert.Equal(t, int32(0), getAndSetMap(tk, nil).userid, "stale token should not be got while bus down")
+
+	for i := 0; i < 50 && busDown(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.False(t, busDown(), "bus should be up")
+	lock.Lock()
+	assert.Equal(t, []EventKind{EventBusUp}, kinds, "bus up event should be sent")
+	lock.Unlock()
+	assert.True(t, mapStale(int32(atomic.LoadInt64(&mapValidAfter))-1), "tokens before subscribed should be stale")
+
+	// another process revokes the token
+	tk, err := MakeToken(3, nil)
+	assert.NoError(t, err, "should not have error when making token")
+	assert.NoError(t, publish(busRevoke, tk), "should not have error when publishing")
+	time.Sleep(200 * time.Millisecond)
+
+	_, ok := peekMap(tk)
+	assert.False(t, ok, "token should be evicted by the message")
+	assert.NoError(t, DelToken(tk), "should not have error when deleting token")
+}
+
+func testPostgresBus(t *testing.T) {
+	dbNotifyChannel = testTableName
+	enableBus(busPostgres)
+	goWorker(func() {
+		startDBListen(dbNotifyChannel)
+	})
+
+	for i := 0; i < 50 && busDown(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.False(t, busDown(), "bus should be up")
+
+	// another process revokes the token
+	tk, err := MakeToken(3, nil)
+	assert.NoError(t, err, "should not have error when making token")
+	assert.NoError(t, publishDB(busMessages(busRevoke, []string{tk})), "should not have error when notifying")
+	time.Sleep(200 * time.Millisecond)
+
+	_, ok := peekMap(tk)
+	assert.False(t, ok, "token should be evicted by the notification")
+	assert.NoError(t, DelToken(tk), "should not have error when deleting token")
+}
@@ -1,7 +1,12 @@
 package kktoken
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -11,13 +16,149 @@ type RDSInfo struct {
 	Pool *redis.Pool
 	// The seconds to live in redis, default: 300
 	LiveSecond uint32
+	// The seconds to remember a token not found in redis, 0 means disabled, default: 0
+	// It protects DB from clients trying invalid tokens again and again.
+	NegativeSecond uint32
+	// How many failed lookups by GetClientUserID in FailWindowSecond to lock out a client IP or ID, 0 means disabled, default: 0
+	FailLimit uint32
+	// The seconds of the window counting failed lookups, default: 60
+	FailWindowSecond uint32
+	// The seconds to reject a client with ErrLocked after reaching FailLimit, default: 300
+	LockoutSecond uint32
+	// How many Redis failures in a row to skip Redis and serve from map and DB, default: 5
+	BreakerFailures uint32
+	// The seconds between PINGs to find Redis back while skipped, default: 5
+	BreakerProbeSecond uint32
+	// The channel to broadcast revocations and suspensions between processes, empty means disabled.
+	// Without it, other processes can accept a deleted token until it expires in their map.
+	Channel string
+	// How many deleted tokens can wait in map to be deleted from Redis while it's skipped, default: 10000
+	// The oldest ones beyond it are dropped, and they are served from Redis until expired in LiveSecond.
+	QueueSize uint32
+	// Also write the userid to the key of the bare token as the versions before the JSON value, default: false
+	// Set it while old processes share the same Redis, so that they don't accept the deleted tokens.
+	// The bare keys are never read.
+	LegacyValue bool
 }
 
+// the value of a token stored in Redis
+type cacheValue struct {
+	UserID   int32          `json:"u"`
+	ExpireAt int32          `json:"e,omitempty"`
+	Scopes   []string       `json:"s,omitempty"`
+	Binding  *clientBinding `json:"b,omitempty"`
+}
+
+// the Redis set of suspended users
+const rdsSuspendKey = "kktoken:suspended"
+
+// the member always kept in the set of suspended users, the set is lost without it
+const rdsSuspendMarker = int32(0)
+
+// the prefix of the Redis keys caching tokens, not to share the keyspace with the other keys
+const rdsTokenPrefix = "kktoken:tk:"
+
 var (
-	rdsPool       *redis.Pool
-	rdsLiveSecond = uint32(300)
+	rdsPool        *redis.Pool
+	rdsLiveSecond  = uint32(300)
+	rdsChannel     string
+	rdsLegacyValue bool
+
+	// errRedisOpen means Redis is skipped by the circuit breaker
+	errRedisOpen = errors.New("redis circuit open")
+	rdsBreaker   *circuitBreaker
+
+	// the tokens to delete from Redis when it's back
+	rdsPending = tokenList{limit: 10000, lock: new(sync.Mutex)}
 )
 
+// the tokens waiting for something, at most limit of them
+type tokenList struct {
+	all   []string
+	limit int
+	// how many are dropped since the last take
+	dropped int
+	lock    *sync.Mutex
+}
+
+// add to append the tokens, the oldest ones are dropped if more than limit.
+func (l *tokenList) add(tokens ...string) {
+	l.lock.Lock()
+	l.all = append(l.all, tokens...)
+	if n := len(l.all) - l.limit; l.limit > 0 && n > 0 {
+		l.dropped += n
+		l.all = append([]string(nil), l.all[n:]...)
+	}
+	l.lock.Unlock()
+}
+
+// take to get and clear all the tokens, and how many are dropped.
+func (l *tokenList) take() ([]string, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	all, dropped := l.all, l.dropped
+	l.all = nil
+	l.dropped = 0
+	return all, dropped
+}
+
+// breakerConn to report the results of a Redis connection to the circuit breaker.
+type breakerConn struct {
+	redis.Conn
+}
+
+func (c breakerConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	// an error reply means Redis is still there
+	_, isReply := err.(redis.Error)
+	rdsBreaker.report(err != nil && !isReply)
+	return reply, err
+}
+
+// rdsGet to get a Redis connection, the error is errRedisOpen while Redis is skipped.
+func rdsGet() (redis.Conn, error) {
+	if !rdsBreaker.allow() {
+		return nil, errRedisOpen
+	}
+	return breakerConn{rdsPool.Get()}, nil
+}
+
+// skipOpen to ignore errRedisOpen for the changes that DB already has.
+func skipOpen(err error) error {
+	if err == errRedisOpen {
+		return nil
+	}
+	return err
+}
+
+// pingRedis to check whether Redis is back.
+func pingRedis() error {
+	conn := rdsPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+// redisBack to apply the changes made while Redis was skipped.
+func redisBack() {
+	tokens, dropped := rdsPending.take()
+	if err := delRedisCache(tokens...); err != nil {
+		sendError(err)
+	}
+	if dropped > 0 {
+		sendError(fmt.Errorf("%d deleted tokens not deleted from redis, they expire in %d seconds", dropped, rdsLiveSecond))
+	}
+
+	// the users might be resumed, DB has all the suspended users
+	userids, err := getAllSuspended()
+	if err == nil {
+		err = resetRedisSuspend(userids)
+	}
+	if err != nil {
+		sendError(err)
+	}
+}
+
 func prepareRedis(rdsInfo *RDSInfo) error {
 	if rdsInfo.Pool == nil {
 		return errors.New("rdsInfo Pool Can't be nil")
@@ -27,6 +168,25 @@ func prepareRedis(rdsInfo *RDSInfo) error {
 		// set the value if not 0
 		rdsLiveSecond = rdsInfo.LiveSecond
 	}
+	rdsNegativeSecond = rdsInfo.NegativeSecond
+	rdsLegacyValue = rdsInfo.LegacyValue
+	if rdsInfo.QueueSize > 0 {
+		rdsPending.limit = int(rdsInfo.QueueSize)
+	}
+	rdsBreaker = newCircuitBreaker("redis", pingRedis, redisBack)
+	if rdsInfo.BreakerFailures > 0 {
+		rdsBreaker.threshold = rdsInfo.BreakerFailures
+	}
+	if rdsInfo.BreakerProbeSecond > 0 {
+		rdsBreaker.probeSecond = rdsInfo.BreakerProbeSecond
+	}
+	rdsFailLimit = rdsInfo.FailLimit
+	if rdsInfo.FailWindowSecond > 0 {
+		rdsFailWindowSecond = rdsInfo.FailWindowSecond
+	}
+	if rdsInfo.LockoutSecond > 0 {
+		rdsLockoutSecond = rdsInfo.LockoutSecond
+	}
 
 	// PING to check redis server
 	conn := rdsInfo.Pool.Get()
@@ -38,51 +198,307 @@ func prepareRedis(rdsInfo *RDSInfo) error {
 	}
 	rdsPool = rdsInfo.Pool
 
+	if rdsInfo.Channel != "" {
+		rdsChannel = rdsInfo.Channel
+		enableBus(busRedis)
+		goWorker(func() {
+			startRedisSubscribe(rdsChannel)
+		})
+	}
+
 	return nil
 }
 
+// startRedisSubscribe to keep subscribing the channel, reconnect with backoff when lost.
+func startRedisSubscribe(channel string) {
+	backoff := time.Second
+	for {
+		subscribed, err := subscribeRedis(channel)
+		setBusUp(busRedis, false)
+		if err != nil {
+			sendError(err)
+		}
+
+		if subscribed {
+			backoff = time.Second
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// subscribeRedis to handle the messages of the channel until the connection is lost.
+// Return whether it was subscribed, and the error.
+func subscribeRedis(channel string) (bool, error) {
+	psc := redis.PubSubConn{Conn: rdsPool.Get()}
+	defer psc.Close()
+
+	if err := psc.Subscribe(channel); err != nil {
+		return false, err
+	}
+
+	// ping to find the lost connection, and not to reach the read timeout of the pool
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		c := time.NewTicker(time.Second)
+		defer c.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-quit:
+				// Receive returns when unsubscribed
+				psc.Unsubscribe()
+				return
+			case <-c.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	subscribed := false
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			if err := handleBusMessage(string(v.Data)); err != nil {
+				sendError(err)
+			}
+		case redis.Subscription:
+			if v.Kind == "subscribe" {
+				subscribed = true
+				setBusUp(busRedis, true)
+			} else if v.Kind == "unsubscribe" && v.Count == 0 {
+				// stopped
+				return subscribed, nil
+			}
+		case error:
+			return subscribed, v
+		}
+	}
+}
+
+// publishRedis to send the messages to the channel.
+func publishRedis(msgs []string) error {
+	conn, err := rdsGet()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, msg := range msgs {
+		conn.Send("PUBLISH", rdsChannel, msg)
+	}
+	_, err = conn.Do("")
+	return err
+}
+
+// tokenKey to get the Redis key caching a token.
+func tokenKey(token string) string {
+	return rdsTokenPrefix + token
+}
+
 // setCache to set cache tokens for users.
-func setRedisCache(tokens []string, userids []int32) error {
-	conn := rdsPool.Get()
+// A token with expire_at will not live in redis longer than it.
+func setRedisCache(tokens []string, latests []tokenLatest) error {
+	conn, err := rdsGet()
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
 	l := len(tokens)
-	if l != len(userids) || l == 0 {
+	if l != len(latests) || l == 0 {
 		return errors.New("parameters wrong for redis batch set")
 	}
 
+	now := time.Now().Unix()
 	conn.Send("MULTI")
 	for i := 0; i < l; i++ {
-		conn.Send("SETEX", tokens[i], rdsLiveSecond, userids[i])
+		ttl := int64(rdsLiveSecond)
+		if latests[i].expireAt > 0 && int64(latests[i].expireAt)-now < ttl {
+			ttl = int64(latests[i].expireAt) - now
+		}
+		if ttl <= 0 {
+			// already expired
+			continue
+		}
+
+		value, err := json.Marshal(cacheValue{
+			UserID:   latests[i].userid,
+			ExpireAt: latests[i].expireAt,
+			Scopes:   latests[i].scopes,
+			Binding:  latests[i].binding,
+		})
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+		conn.Send("SETEX", tokenKey(tokens[i]), ttl, value)
+		if rdsLegacyValue && isToken(tokens[i]) {
+			conn.Send("SETEX", tokens[i], ttl, latests[i].userid)
+		}
 	}
-	_, err := conn.Do("EXEC")
+	_, err = conn.Do("EXEC")
 	return err
 }
 
 // getRedisCache to get a cache from redis.
-// Return userid (0 means not found), error
-func getRedisCache(token string) (int32, error) {
-	conn := rdsPool.Get()
+// Return the token information (userid 0 means not found, missingUserID means known not to exist), error
+func getRedisCache(token string) (tokenLatest, error) {
+	conn, err := rdsGet()
+	if err != nil {
+		return tokenLatest{}, err
+	}
 	defer conn.Close()
 
-	userid, err := redis.Int(conn.Do("GET", token))
+	value, err := redis.Bytes(conn.Do("GET", tokenKey(token)))
 	if err == redis.ErrNil {
-		return 0, nil
+		return tokenLatest{}, nil
 	}
 	if err != nil {
-		return 0, err
+		return tokenLatest{}, err
 	}
 
-	return int32(userid), nil
+	// setRedisMissing sets missingUserID, the others are JSON
+	if string(value) == strconv.Itoa(int(missingUserID)) {
+		return tokenLatest{userid: missingUserID}, nil
+	}
+
+	var cached cacheValue
+	if err := json.Unmarshal(value, &cached); err != nil {
+		return tokenLatest{}, err
+	}
+	return tokenLatest{
+		userid:   cached.UserID,
+		expireAt: cached.ExpireAt,
+		scopes:   cached.Scopes,
+		binding:  cached.Binding,
+	}, nil
 }
 
-// delCache to delete a cache.
-func delRedisCache(token string) error {
-	conn := rdsPool.Get()
+// setRedisMissing to remember a token not found.
+// A token made later overwrites it.
+func setRedisMissing(token string) error {
+	if rdsNegativeSecond == 0 || !isToken(token) {
+		return nil
+	}
+
+	conn, err := rdsGet()
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
-	if _, err := conn.Do("DEL", token); err != nil && err != redis.ErrNil {
+	_, err = conn.Do("SET", tokenKey(token), missingUserID, "EX", rdsNegativeSecond, "NX")
+	return err
+}
+
+// delCache to delete caches.
+func delRedisCache(tokens ...string) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	conn, err := rdsGet()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := make([]interface{}, 0, len(tokens))
+	for i := range tokens {
+		args = append(args, tokenKey(tokens[i]))
+		if rdsLegacyValue && isToken(tokens[i]) {
+			args = append(args, tokens[i])
+		}
+	}
+	if _, err := conn.Do("DEL", args...); err != nil && err != redis.ErrNil {
 		return err
 	}
 	return nil
 }
+
+// addRedisSuspend to add suspended users.
+func addRedisSuspend(userids ...int32) error {
+	if len(userids) == 0 {
+		return nil
+	}
+
+	conn, err := rdsGet()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := []interface{}{rdsSuspendKey}
+	for _, userid := range userids {
+		args = append(args, userid)
+	}
+	_, err = conn.Do("SADD", args...)
+	return err
+}
+
+// remRedisSuspend to remove a suspended user.
+func remRedisSuspend(userid int32) error {
+	conn, err := rdsGet()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("SREM", rdsSuspendKey, userid)
+	return err
+}
+
+// resetRedisSuspend to replace all suspended users.
+func resetRedisSuspend(userids []int32) error {
+	conn, err := rdsGet()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("DEL", rdsSuspendKey)
+	args := []interface{}{rdsSuspendKey, rdsSuspendMarker}
+	for _, userid := range userids {
+		args = append(args, userid)
+	}
+	conn.Send("SADD", args...)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// getRedisSuspend to get all suspended users, false if the set is lost or never reset.
+func getRedisSuspend() ([]int32, bool, error) {
+	conn, err := rdsGet()
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+
+	values, err := redis.Ints(conn.Do("SMEMBERS", rdsSuspendKey))
+	if err != nil {
+		return nil, false, err
+	}
+
+	var found bool
+	userids := make([]int32, 0, len(values))
+	for i := range values {
+		if int32(values[i]) == rdsSuspendMarker {
+			found = true
+			continue
+		}
+		userids = append(userids, int32(values[i]))
+	}
+	return userids, found, nil
+}
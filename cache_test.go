@@ -10,29 +10,29 @@ import (
 
 func testCacheMethods(t *testing.T) {
 	// test empty get.
-	userid, err := getRedisCache("abcdefg")
+	got, err := getRedisCache("abcdefg")
 	assert.NoError(t, err, "should not have error to get non-existed cache")
-	assert.Equal(t, int32(0), userid, "userid wrong")
+	assert.Equal(t, int32(0), got.userid, "userid wrong")
 
 	tk1 := uuid.NewV4().String()
 	tk2 := uuid.NewV4().String()
-	userid = int32(3)
+	userid := int32(3)
 
 	// set cache
-	err = setRedisCache([]string{tk1, tk2}, []int32{userid})
+	err = setRedisCache([]string{tk1, tk2}, []tokenLatest{{userid: userid}})
 	assert.Error(t, err, "should have error when array length not same")
 
-	err = setRedisCache([]string{tk1, tk2}, []int32{userid, userid})
+	err = setRedisCache([]string{tk1, tk2}, []tokenLatest{{userid: userid}, {userid: userid}})
 	assert.NoError(t, err, "should have no error to set cache")
 
 	// get cache
-	gotUserID, err := getRedisCache(tk1)
+	got, err = getRedisCache(tk1)
 	assert.NoError(t, err, "should have no error to get from cache")
-	assert.Equal(t, userid, gotUserID, "userid wrong")
+	assert.Equal(t, userid, got.userid, "userid wrong")
 
-	gotUserID, err = getRedisCache(tk2)
+	got, err = getRedisCache(tk2)
 	assert.NoError(t, err, "should have no error to get from cache")
-	assert.Equal(t, userid, gotUserID, "userid wrong")
+	assert.Equal(t, userid, got.userid, "userid wrong")
 
 	checkTTL(tk1, t)
 
@@ -44,16 +44,39 @@ func testCacheMethods(t *testing.T) {
 	assert.NoError(t, err, "should not have error to delete cache")
 
 	// get cache should return 0
-	gotUserID, err = getRedisCache(tk1)
+	got, err = getRedisCache(tk1)
 	assert.NoError(t, err, "should have no error to get from cache")
-	assert.Equal(t, int32(0), gotUserID, "userid wrong")
+	assert.Equal(t, int32(0), got.userid, "userid wrong")
+}
+
+func testLegacyValue(t *testing.T) {
+	rdsLegacyValue = true
+	defer func() { rdsLegacyValue = false }()
+
+	tk := cleanToken(uuid.NewV4().String())
+	userid := int32(26)
+	err := setRedisCache([]string{tk}, []tokenLatest{{userid: userid}})
+	assert.NoError(t, err, "should have no error to set cache")
+
+	// the versions before read the bare key
+	conn := rdsPool.Get()
+	defer conn.Close()
+	got, err := redis.Int(conn.Do("GET", tk))
+	assert.NoError(t, err, "should have no error to get the bare key")
+	assert.Equal(t, int(userid), got, "userid of the bare key wrong")
+
+	err = delRedisCache(tk)
+	assert.NoError(t, err, "should not have error to delete cache")
+	exists, err := redis.Bool(conn.Do("EXISTS", tk))
+	assert.NoError(t, err, "should have no error to check the bare key")
+	assert.False(t, exists, "the bare key should be deleted")
 }
 
 func checkTTL(tk string, t *testing.T) {
 	conn := rdsPool.Get()
 	defer conn.Close()
 
-	ttl, err := redis.Int(conn.Do("TTL", tk))
+	ttl, err := redis.Int(conn.Do("TTL", tokenKey(tk)))
 	assert.NoError(t, err, "should not have error to get cache TTL")
 	assert.Equal(t, rdsLiveSecond, uint32(ttl), "TTL wrong")
 }
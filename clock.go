@@ -0,0 +1,141 @@
+package kktoken
+
+import "time"
+
+var (
+	// How many evicted tokens wait for the next EXPCheck, they are flushed at once when reached
+	mapEvictedSize = 1000
+	// to flush the evicted tokens before the next EXPCheck
+	evictedFlush = make(chan struct{}, 1)
+)
+
+// setLimit to bound the store to about max tokens, 0 means no limit.
+// It's split evenly among the shards and rounded up, so each shard holds at least one,
+// and the store can have up to one less than the number of the shards more than max.
+func (s *tokenStore) setLimit(max uint32) {
+	s.limit = 0
+	if max > 0 {
+		s.limit = (int(max) + len(s.shards) - 1) / len(s.shards)
+	}
+}
+
+// place to give a new token a slot in the ring of the shard, evicting one by CLOCK if the ring is full.
+// A token used since the hand passed gets a second chance, the evicted one is returned if any.
+// The shard should be locked.
+func (shard *tokenShard) place(tk string, one *tokenLatest, limit int) (string, tokenLatest, bool) {
+	if len(shard.ring) < limit {
+		one.slot = len(shard.ring)
+		shard.ring = append(shard.ring, tk)
+		return "", tokenLatest{}, false
+	}
+
+	for {
+		i := shard.hand
+		shard.hand = (shard.hand + 1) % len(shard.ring)
+
+		// the slot is free if its token is deleted, or given another slot after loaded again
+		evicted := shard.ring[i]
+		old, ok := shard.all[evicted]
+		if ok && old.slot == i && old.referenced {
+			old.referenced = false
+			continue
+		}
+		one.slot = i
+		shard.ring[i] = tk
+		if ok && old.slot == i {
+			delete(shard.all, evicted)
+			return evicted, *old, true
+		}
+		return "", tokenLatest{}, false
+	}
+}
+
+// evictFull to keep the usage of a token evicted from the full store until the next EXPCheck,
+// or flush them at once if there are mapEvictedSize ones.
+func (s *tokenStore) evictFull(tk string, one tokenLatest) {
+	if one.uses == 0 {
+		// the usage is flushed already
+		return
+	}
+	if one.expireAt > 0 && int64(one.expireAt) <= time.Now().Unix() {
+		// reached the absolute expiration, nothing to update
+		return
+	}
+	// only the usage is kept
+	one = tokenLatest{
+		userid:    one.userid,
+		lastUse:   one.lastUse,
+		lastIP:    one.lastIP,
+		lastAgent: one.lastAgent,
+		uses:      one.uses,
+		firstUse:  one.firstUse,
+	}
+
+	s.evicted.lock.Lock()
+	if old, ok := s.evicted.all[tk]; ok {
+		mergeUsage(&old, one)
+		one = old
+	}
+	s.evicted.all[tk] = one
+	full := len(s.evicted.all) >= mapEvictedSize
+	s.evicted.lock.Unlock()
+
+	if full {
+		select {
+		case evictedFlush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// takeEvicted to get the tokens evicted from the full store since the last time.
+func (s *tokenStore) takeEvicted() ([]string, []tokenLatest) {
+	s.evicted.lock.Lock()
+	all := s.evicted.all
+	s.evicted.all = make(map[string]tokenLatest)
+	s.evicted.lock.Unlock()
+
+	tokens := make([]string, 0, len(all))
+	latests := make([]tokenLatest, 0, len(all))
+	for tk, one := range all {
+		tokens = append(tokens, tk)
+		latests = append(latests, one)
+	}
+	return tokens, latests
+}
+
+// reloaded to fold the usage of a token evicted before into it loaded again, not to flush it twice.
+func (s *tokenStore) reloaded(tk string, one *tokenLatest) {
+	s.evicted.lock.Lock()
+	old, ok := s.evicted.all[tk]
+	delete(s.evicted.all, tk)
+	s.evicted.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	mergeUsage(&old, *one)
+	one.lastUse, one.lastIP, one.lastAgent = old.lastUse, old.lastIP, old.lastAgent
+	one.uses, one.firstUse = old.uses, old.firstUse
+}
+
+// mergeEvicted to add the evicted tokens to the tokens to flush, which should be unique.
+// The usage of a token evicted and then loaded again is merged into one.
+func mergeEvicted(tokens []string, latests []tokenLatest, evicted []string, evictedLatest []tokenLatest) ([]string, []tokenLatest) {
+	index := make(map[string]int, len(tokens))
+	for i, tk := range tokens {
+		index[tk] = i
+	}
+	for i, tk := range evicted {
+		if j, ok := index[tk]; ok {
+			merged := evictedLatest[i]
+			mergeUsage(&merged, latests[j])
+			latests[j] = merged
+			continue
+		}
+		index[tk] = len(tokens)
+		tokens = append(tokens, tk)
+		latests = append(latests, evictedLatest[i])
+	}
+	return tokens, latests
+}
@@ -0,0 +1,102 @@
+package kktoken
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testMapLimit(t *testing.T) {
+	// not to race with the background goroutines using the map of the process
+	store := newTokenStore(1)
+	store.setLimit(3)
+
+	now := int32(time.Now().Unix())
+	store.set("a", tokenLatest{userid: 1, uses: 1})
+	store.set("b", tokenLatest{userid: 2, lastUse: now - 10, uses: 2, scopes: []string{"orders:read"}})
+	store.set("c", tokenLatest{userid: 3})
+	assert.Equal(t, int32(1), store.getAndSet("a", nil).userid, "should get a")
+
+	// a is used, so b is evicted
+	store.set("d", tokenLatest{userid: 4})
+	_, ok := store.peek("b")
+	assert.False(t, ok, "b should be evicted")
+	for _, tk := range []string{"a", "c", "d"} {
+		_, ok := store.peek(tk)
+		assert.True(t, ok, "should be kept in map")
+	}
+	tokens, latests := store.takeEvicted()
+	assert.Equal(t, []string{"b"}, tokens, "evicted tokens wrong")
+	assert.Equal(t, now-10, latests[0].lastUse, "last_use should be kept to update DB")
+	assert.Equal(t, int64(2), latests[0].uses, "uses should be kept to update DB")
+	assert.Nil(t, latests[0].scopes, "only the usage should be kept")
+
+	// the slot of a deleted token is used first
+	store.evict([]string{"c"})
+	store.set("e", tokenLatest{userid: 5, uses: 1})
+	for _, tk := range []string{"a", "d", "e"} {
+		_, ok := store.peek(tk)
+		assert.True(t, ok, "should be kept in map")
+	}
+
+	tokens, _ = store.takeEvicted()
+	assert.Len(t, tokens, 0, "nothing should be evicted")
+
+	// the expired tokens and the ones without uses are not updated to DB
+	store.set("f", tokenLatest{userid: 6, expireAt: now - 1})
+	store.set("g", tokenLatest{userid: 7})
+	store.set("h", tokenLatest{userid: 8})
+	store.set("i", tokenLatest{userid: 9})
+	tokens, _ = store.takeEvicted()
+	sort.Strings(tokens)
+	assert.Equal(t, []string{"a", "e"}, tokens, "evicted tokens wrong")
+	assert.Equal(t, 3, len(store.shards[0].all), "map should be bounded")
+
+	// the limit is rounded up for every shard
+	store = newTokenStore(mapShards)
+	store.setLimit(10)
+	assert.Equal(t, 1, store.limit, "every shard should have one token at least")
+}
+
+func testEvictedReload(t *testing.T) {
+	userid := int32(50)
+	now := int32(time.Now().Unix())
+	tokens := makeFlushTokens(t, userid, 2, now)
+	for i := range tokens {
+		tokens[i] = cleanToken(tokens[i])
+	}
+	store := newTokenStore(1)
+	store.setLimit(1)
+
+	store.set(tokens[0], tokenLatest{userid: userid})
+	store.getAndSet(tokens[0], nil)
+	// evicted by the other token, then loaded and used again
+	store.set(tokens[1], tokenLatest{userid: userid})
+	store.set(tokens[0], tokenLatest{userid: userid})
+	store.getAndSet(tokens[0], nil)
+	store.check(time.Now())
+
+	got, err := getAllTokens(userid)
+	assert.NoError(t, err, "should not have error to get all tokens")
+	found := false
+	for _, one := range got {
+		if one.Token == tokens[0] {
+			found = true
+			assert.Equal(t, int64(2), one.UseCount, "the uses before and after evicted should be counted")
+		}
+	}
+	assert.True(t, found, "token should be in DB")
+
+	// evicted again and loaded meanwhile, the usage is flushed once
+	merged, latests := mergeEvicted([]string{"a"}, []tokenLatest{{uses: 1, lastUse: now}},
+		[]string{"a", "b"}, []tokenLatest{{uses: 2, lastUse: now - 1}, {uses: 1}})
+	assert.Equal(t, []string{"a", "b"}, merged, "tokens should be unique")
+	assert.Equal(t, int64(3), latests[0].uses, "uses should be merged")
+	assert.Equal(t, now, latests[0].lastUse, "last_use should be the later one")
+
+	_, _, err = delUserTokens(userid, "")
+	assert.NoError(t, err, "should not have error to delete tokens")
+	assert.NoError(t, delRedisCache(tokens...), "should not have error to delete cache")
+}
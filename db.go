@@ -1,28 +1,47 @@
 package kktoken
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jackc/pgx"
 )
 
+// the columns to query TokenInfo
+const tokenColumns = "token,user_id,info,create_at,last_use,COALESCE(parent::text,''),expire_at,scopes,last_ip,last_agent,use_count,first_use"
+
 var (
 	dbPool             *pgx.ConnPool
 	dbPersistentSecond uint32
+	dbTableName        string
+	dbNotifyChannel    string
+	dbSweepBatch       = uint32(1000)
+	dbSweepPause       = 100 * time.Millisecond
 
 	insertTokenStm      string
 	updateLastUseStm    string
+	updateLastUsesStm   string
 	deleteTokenStm      string
 	getUserIDStm        string
 	getUserIDWithEXPStm string
 	queryTokenStm       string
+	updateInfoStm       string
+	deleteUserTokenStm  string
+	insertSuspendStm    string
+	deleteSuspendStm    string
+	querySuspendStm     string
 )
 
 // DBInfo information for the database
 type DBInfo struct {
+	// Pool to use DB
 	Pool *pgx.ConnPool
 	// PersistentSecond to delete the record after how many seconds from last_use, 0 means never expire
 	PersistentSecond uint32
@@ -30,6 +49,26 @@ type DBInfo struct {
 	TableName string
 	// DBEXPCheckSecond the frequency to check expiration, default: 300
 	EXPCheckSecond uint32
+	// Audit to write the lifecycle events of tokens to table <TableName>_audit, default: false
+	Audit bool
+	// TombstoneSecond to keep why a token is removed in table <TableName>_tombstone for how many seconds, 0 means no tombstone
+	TombstoneSecond uint32
+	// HistorySecond to move the deleted records to table <TableName>_history and keep them for how many seconds, 0 means no history
+	HistorySecond uint32
+	// SweepBatch how many expired records to delete in a statement, default: 1000
+	SweepBatch uint32
+	// SweepPauseMillisecond the pause between the statements deleting expired records, default: 100
+	SweepPauseMillisecond uint32
+	// BreakerFailures how many DB failures in a row to serve only from map and Redis, default: 5
+	BreakerFailures uint32
+	// BreakerProbeSecond the seconds between queries to find DB back while not available, default: 5
+	BreakerProbeSecond uint32
+	// QueueSize how many tokens can wait in map to flush their usage while DB is not available,
+	// the others wait in Redis, default: 10000
+	QueueSize uint32
+	// NotifyChannel to broadcast revocations and suspensions between processes by LISTEN/NOTIFY, empty means disabled.
+	// It takes a connection of the pool for each process.
+	NotifyChannel string
 }
 
 // TokenInfo of a single token
@@ -41,6 +80,75 @@ type TokenInfo struct {
 	UserID   int32
 	CreateAt int32
 	LastUse  int32
+	// the token it derived from, empty for a root token
+	Parent string
+	// the absolute expiration, 0 means never
+	ExpireAt int32
+	// the granted permissions
+	Scopes []string
+	// the client of the last use
+	LastIP        string
+	LastUserAgent string
+	// how many times it is got, and when is the first time, 0 if never
+	UseCount int64
+	FirstUse int32
+
+	// the binding to insert
+	binding *clientBinding
+}
+
+// TokenSort the order to page tokens.
+type TokenSort int
+
+const (
+	// SortCreateAt to sort by create_at.
+	SortCreateAt TokenSort = iota
+	// SortLastUse to sort by last_use, the last_use in DB only updates after map EXPCheck.
+	SortLastUse
+)
+
+// TokenKind the kind of tokens to page.
+type TokenKind int
+
+const (
+	// KindAll for all tokens.
+	KindAll TokenKind = iota
+	// KindRoot for tokens without parent.
+	KindRoot
+	// KindChild for tokens derived from another token.
+	KindChild
+)
+
+// PageQuery the options to page the tokens of a user.
+type PageQuery struct {
+	// How many tokens in a page, default: 50
+	Limit int
+	// The NextCursor of the previous page, empty for the first page.
+	Cursor string
+	SortBy TokenSort
+	// Descending order, like the newest first.
+	Desc bool
+	// Only the tokens not expired.
+	ActiveOnly bool
+	Kind       TokenKind
+}
+
+// TokenPage a page of tokens.
+type TokenPage struct {
+	Tokens []TokenInfo
+	// The cursor for the next page, empty if no more.
+	NextCursor string
+	// The count of all tokens matching the query.
+	Total int
+}
+
+// InfoFilter a condition on a field of the attached information.
+type InfoFilter struct {
+	Key string
+	// One of "=", "!=", "<", "<=", ">", ">=".
+	// Only values of the same JSON type are compared, numbers numerically and strings lexically.
+	Op    string
+	Value interface{}
 }
 
 // prepareDB to prepare the database.
@@ -51,11 +159,22 @@ func prepareDB(info *DBInfo) error {
 	// setup the info
 	dbPool = info.Pool
 	dbPersistentSecond = info.PersistentSecond
+	dbBreaker = newCircuitBreaker("postgres", pingDB, replayFlush)
+	if info.BreakerFailures > 0 {
+		dbBreaker.threshold = info.BreakerFailures
+	}
+	if info.BreakerProbeSecond > 0 {
+		dbBreaker.probeSecond = info.BreakerProbeSecond
+	}
+	if info.QueueSize > 0 {
+		dbQueueSize = info.QueueSize
+	}
 
 	tableName := info.TableName
 	if tableName == "" {
 		tableName = "token"
 	}
+	dbTableName = tableName
 
 	// create db if not exist
 	s := `CREATE TABLE IF NOT EXISTS %s (
@@ -80,105 +199,829 @@ func prepareDB(info *DBInfo) error {
 		return err
 	}
 
-	// if needs to expire, start checker in a goroutine
-	if dbPersistentSecond > 0 {
-		if info.EXPCheckSecond == 0 {
-			info.EXPCheckSecond = 300
+	// add the columns for child tokens, a child is deleted together with its parent
+	s = `ALTER TABLE %s
+	ADD COLUMN IF NOT EXISTS parent UUID REFERENCES %s(token) ON DELETE CASCADE,
+	ADD COLUMN IF NOT EXISTS expire_at INTEGER NOT NULL DEFAULT 0;`
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName, tableName)); err != nil {
+		return err
+	}
+
+	// create index if not exist for expire_at to find the tokens reaching it
+	s = "CREATE INDEX IF NOT EXISTS %s_expire_at_index ON %s USING btree (expire_at) WHERE expire_at > 0;"
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName, tableName)); err != nil {
+		return err
+	}
+
+	// add the column for the granted permissions
+	s = "ALTER TABLE %s ADD COLUMN IF NOT EXISTS scopes TEXT[] NOT NULL DEFAULT '{}';"
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName)); err != nil {
+		return err
+	}
+
+	// add the column for the client binding
+	s = "ALTER TABLE %s ADD COLUMN IF NOT EXISTS binding JSONB;"
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName)); err != nil {
+		return err
+	}
+
+	// add the columns for the client of the last use
+	s = `ALTER TABLE %s
+	ADD COLUMN IF NOT EXISTS last_ip TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS last_agent TEXT NOT NULL DEFAULT '';`
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName)); err != nil {
+		return err
+	}
+
+	// add the columns for the use statistics
+	s = `ALTER TABLE %s
+	ADD COLUMN IF NOT EXISTS use_count BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS first_use INTEGER NOT NULL DEFAULT 0;`
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName)); err != nil {
+		return err
+	}
+
+	// create index if not exist for info to search tokens by info
+	s = "CREATE INDEX IF NOT EXISTS %s_info_index ON %s USING gin (info jsonb_path_ops);"
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName, tableName)); err != nil {
+		return err
+	}
+
+	// create index if not exist for parent to find the children
+	s = "CREATE INDEX IF NOT EXISTS %s_parent_index ON %s USING btree (parent);"
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName, tableName)); err != nil {
+		return err
+	}
+
+	// create the table for suspended users
+	s = `CREATE TABLE IF NOT EXISTS %s_suspend (
+	user_id INTEGER PRIMARY KEY,
+	suspend_at INTEGER NOT NULL);`
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName)); err != nil {
+		return err
+	}
+
+	// create the audit table if needed
+	if info.Audit {
+		if err := prepareAudit(tableName); err != nil {
+			return err
+		}
+	}
+
+	// create the history table if needed
+	if info.HistorySecond > 0 {
+		if err := prepareHistory(tableName, info.HistorySecond); err != nil {
+			return err
+		}
+	}
+
+	// create the tombstone table if needed
+	if info.TombstoneSecond > 0 {
+		if err := prepareTombstone(tableName, info.TombstoneSecond); err != nil {
+			return err
 		}
-		go startDBEXPCheck(info.EXPCheckSecond, tableName)
 	}
 
+	if info.SweepBatch > 0 {
+		dbSweepBatch = info.SweepBatch
+	}
+	if info.SweepPauseMillisecond > 0 {
+		dbSweepPause = time.Duration(info.SweepPauseMillisecond) * time.Millisecond
+	}
+
+	// start checker in a goroutine, tokens with expire_at need to be deleted even never expire by last_use
+	if info.EXPCheckSecond == 0 {
+		info.EXPCheckSecond = 300
+	}
+	seconds := info.EXPCheckSecond
+	goWorker(func() {
+		startDBEXPCheck(seconds, tableName)
+	})
+
 	// create SQL statements
-	insertTokenStm = fmt.Sprintf("INSERT INTO %s(token,user_id,info,create_at,last_use) VALUES($1,$2,$3,$4,$5)", tableName)
-	updateLastUseStm = fmt.Sprintf("UPDATE %s SET last_use=$1 WHERE token=$2", tableName)
-	deleteTokenStm = fmt.Sprintf("DELETE FROM %s WHERE token=$1", tableName)
-	getUserIDStm = fmt.Sprintf("SELECT user_id FROM %s WHERE token=$1", tableName)
-	getUserIDWithEXPStm = fmt.Sprintf("SELECT user_id FROM %s WHERE token=$1 AND last_use>$2", tableName)
-	queryTokenStm = fmt.Sprintf("SELECT token,info,create_at,last_use FROM %s WHERE user_id=$1", tableName)
+	insertTokenStm = fmt.Sprintf("INSERT INTO %s(token,user_id,info,create_at,last_use,parent,expire_at,scopes,binding) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9)", tableName)
+	updateLastUseStm = fmt.Sprintf(`UPDATE %s SET last_use=GREATEST(last_use,$1),
+	last_ip=COALESCE(NULLIF($2,''),last_ip),last_agent=COALESCE(NULLIF($3,''),last_agent),
+	use_count=use_count+$4,first_use=CASE WHEN first_use=0 THEN $5 ELSE first_use END WHERE token=$6`, tableName)
+	updateLastUsesStm = fmt.Sprintf(`UPDATE %s AS t SET last_use=GREATEST(t.last_use,u.l),
+	last_ip=COALESCE(NULLIF(u.i,''),t.last_ip),last_agent=COALESCE(NULLIF(u.a,''),t.last_agent),
+	use_count=t.use_count+u.n,first_use=CASE WHEN t.first_use=0 THEN u.f ELSE t.first_use END
+	FROM unnest($1::text[],$2::integer[],$3::text[],$4::text[],$5::bigint[],$6::integer[]) AS u(tk,l,i,a,n,f)
+	WHERE t.token=u.tk::uuid`, tableName)
+	getUserIDStm = fmt.Sprintf("SELECT user_id,expire_at,scopes,binding FROM %s WHERE token=$1 AND (expire_at=0 OR expire_at>$2)", tableName)
+	getUserIDWithEXPStm = fmt.Sprintf("SELECT user_id,expire_at,scopes,binding FROM %s WHERE token=$1 AND (expire_at=0 OR expire_at>$2) AND last_use>$3", tableName)
+	queryTokenStm = fmt.Sprintf("SELECT %s FROM %s WHERE user_id=$1", tokenColumns, tableName)
+	updateInfoStm = fmt.Sprintf("UPDATE %s SET info=$1 WHERE token=$2", tableName)
+	insertSuspendStm = fmt.Sprintf("INSERT INTO %s_suspend(user_id,suspend_at) VALUES($1,$2) ON CONFLICT (user_id) DO NOTHING", tableName)
+	deleteSuspendStm = fmt.Sprintf("DELETE FROM %s_suspend WHERE user_id=$1", tableName)
+	querySuspendStm = fmt.Sprintf("SELECT user_id FROM %s_suspend", tableName)
+	deleteTokenStm = deleteTreeSQL("token=$1", 1)
+	deleteUserTokenStm = deleteTreeSQL("user_id=$1", 1)
+
+	// the listener is started after Redis is prepared
+	if info.NotifyChannel != "" {
+		dbNotifyChannel = info.NotifyChannel
+		enableBus(busPostgres)
+	}
 
 	return nil
 }
 
+// deleteTreeSQL to get the statement deleting the matched tokens with all their descendants.
+// The where has n arguments, and the reason is the next one if the history is enabled.
+func deleteTreeSQL(where string, n int) string {
+	tree := fmt.Sprintf(`WITH RECURSIVE tree AS (
+	SELECT token FROM %s WHERE %s
+	UNION
+	SELECT c.token FROM %s c JOIN tree ON c.parent=tree.token)`, dbTableName, where, dbTableName)
+	if dbHistorySecond == 0 {
+		return fmt.Sprintf("%s\n\tDELETE FROM %s WHERE token IN (SELECT token FROM tree) RETURNING token,user_id", tree, dbTableName)
+	}
+
+	return fmt.Sprintf(`%s,
+	deleted AS (DELETE FROM %s WHERE token IN (SELECT token FROM tree) RETURNING *),
+	%s
+	SELECT token,user_id FROM deleted`, tree, dbTableName,
+		archiveSQL(dbTableName, fmt.Sprintf("'%s'", StateRevoked), fmt.Sprintf("$%d::text", n+1), "extract(epoch from now())::integer"))
+}
+
+// dbRunner to run the statements on the pool, or on a connection of it.
+type dbRunner interface {
+	Exec(sql string, arguments ...interface{}) (pgx.CommandTag, error)
+	Query(sql string, args ...interface{}) (*pgx.Rows, error)
+}
+
+// sweepLeader the leadership to delete the expired records among processes sharing the table.
+// The leader takes a session advisory lock on a connection of the pool for each sweep, and runs the sweep on it,
+// so that no other connection is needed meanwhile. PostgreSQL releases the lock when the process dies.
+type sweepLeader struct {
+	key  int64
+	conn *pgx.Conn
+	// whether it led the last sweep, to tell the change
+	leading bool
+}
+
+// advisoryKey to get the advisory lock key of a name.
+func advisoryKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("kktoken:" + name))
+	return int64(h.Sum64())
+}
+
+// elect to try to lead a sweep, the connection holding the lock is l.conn until resign.
+func (l *sweepLeader) elect() (bool, error) {
+	conn, err := dbPool.Acquire()
+	if err != nil {
+		return false, err
+	}
+	var locked bool
+	if err := conn.QueryRow("SELECT pg_try_advisory_lock($1)", l.key).Scan(&locked); err != nil || !locked {
+		dbPool.Release(conn)
+		l.lead(false)
+		return false, err
+	}
+	l.conn = conn
+	l.lead(true)
+	return true, nil
+}
+
+// resign to release the lock and the connection after a sweep.
+func (l *sweepLeader) resign() {
+	if l.conn == nil {
+		return
+	}
+	var unlocked bool
+	if err := l.conn.QueryRow("SELECT pg_advisory_unlock($1)", l.key).Scan(&unlocked); err != nil || !unlocked {
+		// close it to release the lock
+		l.conn.Close()
+	}
+	dbPool.Release(l.conn)
+	l.conn = nil
+}
+
+// lead to tell the observer whether this process leads the sweeps now.
+func (l *sweepLeader) lead(leading bool) {
+	if leading == l.leading {
+		return
+	}
+	l.leading = leading
+	if leading {
+		emit(Event{Kind: EventLeader, Detail: dbTableName})
+	} else {
+		emit(Event{Kind: EventLeaderLost, Detail: dbTableName})
+	}
+}
+
 // startDBEXPCheck to delete all records that expired running every given seconds.
+// Only the leader among processes sharing the table deletes them, in batches until all deleted or stopped.
 func startDBEXPCheck(seconds uint32, tableName string) {
-	delExpStm := fmt.Sprintf("DELETE FROM %s WHERE last_use < $1", tableName)
-	c := time.Tick(time.Duration(seconds) * time.Second)
-	for now := range c {
-		if _, err := dbPool.Exec(delExpStm, now.Unix()-int64(dbPersistentSecond)); err != nil {
+	delExpStm := delExpiredSQL(tableName)
+	leader := &sweepLeader{key: advisoryKey(tableName)}
+	defer leader.lead(false)
+
+	c := time.NewTicker(time.Duration(seconds) * time.Second)
+	defer c.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-quit:
+			return
+		case now = <-c.C:
+		}
+		if !dbBreaker.allow() {
+			// wait for DB back
+			continue
+		}
+
+		if ok, err := leader.elect(); err != nil {
+			reportDB(err)
+			sendError(err)
+			continue
+		} else if !ok {
+			continue
+		}
+
+		// last_use is always positive, so 0 will never delete by last_use
+		idle := int64(0)
+		if dbPersistentSecond > 0 {
+			idle = now.Unix() - int64(dbPersistentSecond)
+		}
+		if err := purgeTombstones(leader.conn, now.Unix()); err != nil {
+			sendError(err)
+		}
+		if err := purgeHistory(leader.conn, now.Unix()); err != nil {
+			sendError(err)
+		}
+
+		stopped := sweepExpired(leader.conn, delExpStm, idle, now.Unix())
+		leader.resign()
+		if stopped {
+			return
+		}
+	}
+}
+
+// delExpiredSQL to get the statement deleting a batch of expired records.
+// The descendants are deleted and returned with them instead of by the cascade of the parent column,
+// to be written as revoked with the reason "parent", and moved to the history table if enabled.
+func delExpiredSQL(tableName string) string {
+	tree := fmt.Sprintf(`WITH RECURSIVE expired AS (
+	SELECT token FROM %s WHERE last_use < $1 OR (expire_at > 0 AND expire_at <= $2) LIMIT $3),
+	tree AS (SELECT token FROM expired
+	UNION
+	SELECT c.token FROM %s c JOIN tree ON c.parent=tree.token),
+	deleted AS (DELETE FROM %s WHERE token IN (SELECT token FROM tree) RETURNING *)`, tableName, tableName, tableName)
+	selected := "SELECT token,user_id,(expire_at > 0 AND expire_at <= $2),token IN (SELECT token FROM expired) FROM deleted"
+	if dbHistorySecond == 0 {
+		return fmt.Sprintf("%s\n\t%s", tree, selected)
+	}
+
+	state := fmt.Sprintf(`CASE WHEN token NOT IN (SELECT token FROM expired) THEN '%s'
+	WHEN expire_at > 0 AND expire_at <= $2 THEN '%s' ELSE '%s' END`, StateRevoked, StateExpiredAbsolute, StateExpiredIdle)
+	reason := "CASE WHEN token IN (SELECT token FROM expired) THEN '' ELSE 'parent' END"
+	return fmt.Sprintf("%s,\n\t%s\n\t%s", tree, archiveSQL(tableName, state, reason, "$2"), selected)
+}
+
+// sweepExpired to delete the expired records batch by batch with a pause between them.
+// Return whether it's stopped.
+func sweepExpired(db dbRunner, delExpStm string, idle, now int64) bool {
+	total := 0
+	defer func() {
+		emit(Event{Kind: EventSweepDone, Detail: dbTableName, Count: total})
+	}()
+
+	for {
+		count, err := delExpired(db, delExpStm, idle, now)
+		if err != nil {
 			// if there is an error, go to chan
-			errChan <- err
+			sendError(err)
+			return false
+		}
+
+		total += count
+		if count < int(dbSweepBatch) {
+			return false
+		}
+		emit(Event{Kind: EventSweep, Detail: dbTableName, Count: total})
+
+		select {
+		case <-quit:
+			return true
+		case <-time.After(dbSweepPause):
 		}
 	}
 }
 
+// delExpired to delete a batch of the expired records and write them to the audit and tombstone tables.
+// The descendants deleted with them are written as revoked with the reason "parent", and evicted from map and Redis.
+// Return how many records deleted.
+func delExpired(db dbRunner, delExpStm string, idle, now int64) (int, error) {
+	var tokens, reasons, states []string
+	var userids []int32
+	var children []string
+	var childUserIDs []int32
+	rows, _ := db.Query(delExpStm, idle, now, dbSweepBatch)
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for rows.Next() {
+		var tk string
+		var userid int32
+		var absolute, expired bool
+		if err := rows.Scan(&tk, &userid, &absolute, &expired); err != nil {
+			return 0, err
+		}
+		if !expired {
+			children = append(children, cleanToken(tk))
+			childUserIDs = append(childUserIDs, userid)
+			continue
+		}
+		reason, state := "idle", StateExpiredIdle
+		if absolute {
+			reason, state = "absolute", StateExpiredAbsolute
+		}
+		tokens = append(tokens, tk)
+		userids = append(userids, userid)
+		reasons = append(reasons, reason)
+		states = append(states, string(state))
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	count := len(tokens) + len(children)
+	if len(children) > 0 {
+		// they might be cached as they are not expired
+		if err := evictTokens(children); err != nil {
+			return count, err
+		}
+	}
+	if err := addTombstones(db, tokens, userids, states, []string{""}); err != nil {
+		return count, err
+	}
+	if err := addTombstones(db, children, childUserIDs, []string{string(StateRevoked)}, []string{"parent"}); err != nil {
+		return count, err
+	}
+	if err := addAudit(db, AuditExpire, userids, tokens, reasons, nil); err != nil {
+		return count, err
+	}
+	return count, addAudit(db, AuditRevoke, childUserIDs, children, []string{"parent"}, nil)
+}
+
 // setToken to set token.
 func setToken(info *TokenInfo) error {
-	_, err := dbPool.Exec(insertTokenStm, info.Token, info.UserID, info.Info, info.CreateAt, info.LastUse)
-	return err
+	// a root token has NULL parent
+	var parent *string
+	if info.Parent != "" {
+		parent = &info.Parent
+	}
+	// scopes is NOT NULL
+	scopes := info.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+	_, err := dbPool.Exec(insertTokenStm, info.Token, info.UserID, info.Info, info.CreateAt, info.LastUse, parent, info.ExpireAt, scopes, info.binding)
+	return reportDB(err)
 }
 
-func updateToken(token string, lastUse int32) error {
-	_, err := dbPool.Exec(updateLastUseStm, lastUse, token)
+// updateToken to flush the usage in map, empty client will not be updated.
+func updateToken(token string, one tokenLatest) error {
+	_, err := dbPool.Exec(updateLastUseStm, one.lastUse, one.lastIP, one.lastAgent, one.uses, one.firstUse, token)
 	// no rows found in DB, maybe requested from cache, so this shouldn't be an error
-	if err == pgx.ErrNoRows {
+	if err == pgx.ErrNoRows || isInvalidUUID(err) {
 		return nil
 	}
-	return err
+	return reportDB(err)
 }
 
-// getUserID to get userid from token.
+// updateTokens to flush the usage of tokens in one statement, the tokens should be unique.
+// The malformed tokens are skipped, and the tokens are updated one by one if the statement is rejected by DB.
+func updateTokens(tokens []string, latests []tokenLatest) error {
+	l := len(tokens)
+	if l != len(latests) {
+		return errors.New("parameters wrong for batch update")
+	}
+
+	valid := make([]string, 0, l)
+	lastUses := make([]int32, 0, l)
+	lastIPs := make([]string, 0, l)
+	lastAgents := make([]string, 0, l)
+	uses := make([]int64, 0, l)
+	firstUses := make([]int32, 0, l)
+	for i := range latests {
+		// one malformed token fails the cast of the whole batch
+		if !isToken(cleanToken(tokens[i])) {
+			continue
+		}
+		valid = append(valid, tokens[i])
+		lastUses = append(lastUses, latests[i].lastUse)
+		lastIPs = append(lastIPs, latests[i].lastIP)
+		lastAgents = append(lastAgents, latests[i].lastAgent)
+		uses = append(uses, latests[i].uses)
+		firstUses = append(firstUses, latests[i].firstUse)
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+
+	_, err := dbPool.Exec(updateLastUsesStm, valid, lastUses, lastIPs, lastAgents, uses, firstUses)
+	if _, ok := err.(pgx.PgError); !ok {
+		return reportDB(err)
+	}
+	reportDB(err)
+
+	// the batch is rejected, update one by one to keep the others
+	var last error
+	for i := range tokens {
+		if !isToken(cleanToken(tokens[i])) {
+			continue
+		}
+		if err := updateToken(tokens[i], latests[i]); err != nil {
+			if isDBDown(err) {
+				return err
+			}
+			last = err
+		}
+	}
+	return last
+}
+
+// getUserID to get userid and cache information from token.
 // if userid == 0, meaning not found
-func getUserID(token string) (int32, error) {
-	var userid int32
+func getUserID(token string) (tokenLatest, error) {
+	var one tokenLatest
 	var err error
 	now := time.Now().Unix()
 
 	if dbPersistentSecond == 0 {
-		// get userid without checking the expiration
-		err = dbPool.QueryRow(getUserIDStm, token).Scan(&userid)
+		// get userid without checking the idle expiration
+		err = dbPool.QueryRow(getUserIDStm, token, now).Scan(&one.userid, &one.expireAt, &one.scopes, &one.binding)
 	} else {
 		// only get the non-expired token
-		err = dbPool.QueryRow(getUserIDWithEXPStm, token, now-int64(dbPersistentSecond)).Scan(&userid)
+		err = dbPool.QueryRow(getUserIDWithEXPStm, token, now, now-int64(dbPersistentSecond)).Scan(&one.userid, &one.expireAt, &one.scopes, &one.binding)
 	}
 
 	// nothing found
 	if err == pgx.ErrNoRows {
-		return 0, nil
+		return tokenLatest{}, nil
 	}
+	reportDB(err)
 	// not a valid UUID
-	if err, ok := err.(pgx.PgError); ok && err.Code == "22P02" {
-		return 0, nil
+	if isInvalidUUID(err) {
+		return tokenLatest{}, nil
 	}
 	if err != nil {
-		return 0, err
+		return tokenLatest{}, err
 	}
 
-	return userid, nil
+	return one, nil
+}
+
+// isInvalidUUID to check whether the error is caused by an invalid UUID.
+func isInvalidUUID(err error) bool {
+	pgErr, ok := err.(pgx.PgError)
+	return ok && pgErr.Code == "22P02"
 }
 
 func getAllTokens(userid int32) ([]TokenInfo, error) {
-	var tokens []TokenInfo
 	rows, _ := dbPool.Query(queryTokenStm, userid)
+	return scanTokens(rows)
+}
+
+// scanTokens to get all token information from rows selected with tokenColumns.
+func scanTokens(rows *pgx.Rows) ([]TokenInfo, error) {
+	var tokens []TokenInfo
 	if err := rows.Err(); err != nil {
 		return tokens, err
 	}
 
-	// get all token information of a user
 	for rows.Next() {
 		var one TokenInfo
-		if err := rows.Scan(&one.Token, &one.Info, &one.CreateAt, &one.LastUse); err != nil {
+		if err := rows.Scan(&one.Token, &one.UserID, &one.Info, &one.CreateAt, &one.LastUse, &one.Parent, &one.ExpireAt, &one.Scopes, &one.LastIP, &one.LastUserAgent, &one.UseCount, &one.FirstUse); err != nil {
 			return tokens, err
 		}
-		// remove "-" and lower case
-		one.Token = strings.ToLower(strings.Replace(one.Token, "-", "", -1))
-		one.UserID = userid
+		one.Token = cleanToken(one.Token)
+		one.Parent = cleanToken(one.Parent)
 		tokens = append(tokens, one)
 	}
-	return tokens, nil
+	return tokens, rows.Err()
+}
+
+// encodeCursor to encode the sorted value and token of the last one in a page.
+func encodeCursor(value int32, token string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d_%s", value, token)))
 }
 
-// delToken to delete a certain token.
-func delToken(token string) error {
-	_, err := dbPool.Exec(deleteTokenStm, token)
-	return err
+// decodeCursor to get the sorted value and token from a cursor.
+func decodeCursor(cursor string) (int32, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", errors.New("invalid cursor")
+	}
+	parts := strings.SplitN(string(b), "_", 2)
+	if len(parts) != 2 {
+		return 0, "", errors.New("invalid cursor")
+	}
+	value, err := strconv.ParseInt(parts[0], 10, 32)
+	if err != nil {
+		return 0, "", errors.New("invalid cursor")
+	}
+	return int32(value), parts[1], nil
+}
+
+// getTokensPage to get a page of tokens of a user with the total count.
+func getTokensPage(userid int32, q *PageQuery) (*TokenPage, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	column := "create_at"
+	if q.SortBy == SortLastUse {
+		column = "last_use"
+	}
+
+	// the filters for both count and page
+	conds := []string{"user_id=$1"}
+	args := []interface{}{userid}
+	if q.ActiveOnly {
+		now := time.Now().Unix()
+		args = append(args, now)
+		conds = append(conds, fmt.Sprintf("(expire_at=0 OR expire_at>$%d)", len(args)))
+		if dbPersistentSecond > 0 {
+			args = append(args, now-int64(dbPersistentSecond))
+			conds = append(conds, fmt.Sprintf("last_use>$%d", len(args)))
+		}
+	}
+	switch q.Kind {
+	case KindRoot:
+		conds = append(conds, "parent IS NULL")
+	case KindChild:
+		conds = append(conds, "parent IS NOT NULL")
+	}
+
+	page := &TokenPage{}
+	s := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", dbTableName, strings.Join(conds, " AND "))
+	if err := dbPool.QueryRow(s, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	// keyset after the cursor, token breaks the tie
+	op, order := ">", "ASC"
+	if q.Desc {
+		op, order = "<", "DESC"
+	}
+	if q.Cursor != "" {
+		value, token, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value, token)
+		conds = append(conds, fmt.Sprintf("(%s,token)%s($%d,$%d::uuid)", column, op, len(args)-1, len(args)))
+	}
+
+	// get one more to know whether there is a next page
+	s = fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s %s,token %s LIMIT %d",
+		tokenColumns, dbTableName, strings.Join(conds, " AND "), column, order, order, limit+1)
+	rows, _ := dbPool.Query(s, args...)
+	tokens, err := scanTokens(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) > limit {
+		tokens = tokens[:limit]
+		last := tokens[limit-1]
+		value := last.CreateAt
+		if q.SortBy == SortLastUse {
+			value = last.LastUse
+		}
+		page.NextCursor = encodeCursor(value, last.Token)
+	}
+	page.Tokens = tokens
+	return page, nil
+}
+
+// infoWhere to build the condition and arguments of info filters.
+// The arguments start from $1.
+func infoWhere(filters []InfoFilter) (string, []interface{}, error) {
+	if len(filters) == 0 {
+		return "", nil, errors.New("info filters can't be empty")
+	}
+
+	var conds []string
+	var args []interface{}
+	for _, f := range filters {
+		if f.Key == "" {
+			return "", nil, errors.New("info filter key can't be empty")
+		}
+
+		switch f.Op {
+		case "=", "!=":
+			// containment can use the GIN index
+			args = append(args, map[string]interface{}{f.Key: f.Value})
+			cond := fmt.Sprintf("info @> $%d", len(args))
+			if f.Op == "!=" {
+				cond = "NOT " + cond
+			}
+			conds = append(conds, cond)
+		case "<", "<=", ">", ">=":
+			// only compare values of the same JSON type, numbers are compared numerically
+			value, err := json.Marshal(f.Value)
+			if err != nil {
+				return "", nil, err
+			}
+			args = append(args, f.Key, string(value))
+			k, v := len(args)-1, len(args)
+			conds = append(conds, fmt.Sprintf("(jsonb_typeof(info->$%d::text)=jsonb_typeof($%d::jsonb) AND info->$%d::text %s $%d::jsonb)", k, v, k, f.Op, v))
+		default:
+			return "", nil, fmt.Errorf("invalid info filter operator: %s", f.Op)
+		}
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// findTokens to get the tokens matching all the info filters, limit 0 means no limit.
+func findTokens(filters []InfoFilter, limit int) ([]TokenInfo, error) {
+	where, args, err := infoWhere(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	s := fmt.Sprintf("SELECT %s FROM %s WHERE %s", tokenColumns, dbTableName, where)
+	if limit > 0 {
+		s += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, _ := dbPool.Query(s, args...)
+	return scanTokens(rows)
+}
+
+// delToken to delete a certain token with all its descendants, the reason is for the history.
+// Return all the deleted tokens and their userids.
+func delToken(token, reason string) ([]string, []int32, error) {
+	rows, _ := dbPool.Query(deleteTokenStm, historyArgs([]interface{}{token}, reason)...)
+	return scanDeleted(rows)
+}
+
+// delUserTokens to delete all the tokens of a user, the reason is for the history.
+// Return all the deleted tokens and their userids.
+func delUserTokens(userid int32, reason string) ([]string, []int32, error) {
+	rows, _ := dbPool.Query(deleteUserTokenStm, historyArgs([]interface{}{userid}, reason)...)
+	return scanDeleted(rows)
+}
+
+// updateInfo to replace the attached information of a token.
+// Return whether the token is found.
+func updateInfo(token string, info map[string]interface{}) (bool, error) {
+	tag, err := dbPool.Exec(updateInfoStm, info, token)
+	if isInvalidUUID(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, reportDB(err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// delTokensByInfo to delete the tokens matching all the info filters with all their descendants.
+// Return all the deleted tokens and their userids.
+func delTokensByInfo(filters []InfoFilter) ([]string, []int32, error) {
+	where, args, err := infoWhere(filters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, _ := dbPool.Query(deleteTreeSQL(where, len(args)), historyArgs(args, "info")...)
+	return scanDeleted(rows)
+}
+
+// scanDeleted to get the tokens and userids returned by deleteTreeSQL.
+func scanDeleted(rows *pgx.Rows) ([]string, []int32, error) {
+	var tokens []string
+	var userids []int32
+	if err := rows.Err(); err != nil {
+		return tokens, userids, err
+	}
+
+	for rows.Next() {
+		var tk string
+		var userid int32
+		if err := rows.Scan(&tk, &userid); err != nil {
+			return tokens, userids, err
+		}
+		tokens = append(tokens, cleanToken(tk))
+		userids = append(userids, userid)
+	}
+	return tokens, userids, rows.Err()
+}
+
+// setSuspend to record a suspended user.
+func setSuspend(userid int32) error {
+	_, err := dbPool.Exec(insertSuspendStm, userid, time.Now().Unix())
+	return reportDB(err)
+}
+
+// delSuspend to remove a suspended user.
+func delSuspend(userid int32) error {
+	_, err := dbPool.Exec(deleteSuspendStm, userid)
+	return reportDB(err)
+}
+
+// getAllSuspended to get all suspended users.
+func getAllSuspended() ([]int32, error) {
+	var userids []int32
+	rows, _ := dbPool.Query(querySuspendStm)
+	if err := rows.Err(); err != nil {
+		return userids, err
+	}
+
+	for rows.Next() {
+		var userid int32
+		if err := rows.Scan(&userid); err != nil {
+			return userids, err
+		}
+		userids = append(userids, userid)
+	}
+	return userids, rows.Err()
+}
+
+// startDBListen to keep listening the channel, reconnect with backoff when lost.
+func startDBListen(channel string) {
+	backoff := time.Second
+	for {
+		listened, err := listenDB(channel)
+		setBusUp(busPostgres, false)
+		if err != nil {
+			sendError(err)
+		}
+
+		if listened {
+			backoff = time.Second
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// listenDB to handle the notifications of the channel until the connection is lost.
+// Return whether it was listened, and the error.
+func listenDB(channel string) (bool, error) {
+	conn, err := dbPool.Acquire()
+	if err != nil {
+		return false, err
+	}
+	defer dbPool.Release(conn)
+
+	if err := conn.Listen(channel); err != nil {
+		return false, err
+	}
+	// the connection goes back to the pool
+	defer conn.Unlisten(channel)
+	setBusUp(busPostgres, true)
+
+	for {
+		// wake up every second to find the lost connection by a ping, like the Redis subscription,
+		// a half-open connection is not found by waiting until the TCP keepalive gives up
+		ctx, cancel := context.WithTimeout(stopCtx, time.Second)
+		notification, err := conn.WaitForNotification(ctx)
+		cancel()
+		if stopCtx.Err() != nil {
+			// stopped
+			return true, nil
+		}
+
+		if err == context.DeadlineExceeded && conn.IsAlive() {
+			ctx, cancel = context.WithTimeout(stopCtx, 5*time.Second)
+			err = conn.Ping(ctx)
+			cancel()
+			if err == nil {
+				continue
+			} else if stopCtx.Err() != nil {
+				return true, nil
+			}
+		}
+		if err != nil {
+			return true, err
+		}
+
+		if err := handleBusMessage(notification.Payload); err != nil {
+			sendError(err)
+		}
+	}
+}
+
+// publishDB to send the messages to the channel, a message should be less than 8000 bytes.
+func publishDB(msgs []string) error {
+	for _, msg := range msgs {
+		if _, err := dbPool.Exec("SELECT pg_notify($1,$2)", dbNotifyChannel, msg); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -2,6 +2,7 @@ package kktoken
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,22 +21,206 @@ func testDBMethods(t *testing.T) {
 	getEmpty(t)
 	deleteEmpty(t)
 	testCRUD(t)
+	testInfoWhere(t)
+	testCursor(t)
+	testTokensPage(t)
+	testSweepLeader(t)
+	testSweepBatches(t)
+	testFlushBatches(t)
 	testEXPCheck(t)
 }
 
 func deleteEmpty(t *testing.T) {
-	err := delToken(uuid.NewV1().String())
+	_, _, err := delToken(uuid.NewV1().String(), "")
 	assert.NoError(t, err, "should not have error to delete non-existed token")
 }
 
 func getEmpty(t *testing.T) {
-	userid, err := getUserID("aa")
+	got, err := getUserID("aa")
 	assert.NoError(t, err, "should not have error with an invalid UUID")
-	assert.EqualValues(t, 0, userid, "userid should be 0 when not exist")
+	assert.EqualValues(t, 0, got.userid, "userid should be 0 when not exist")
 
-	userid, err = getUserID(uuid.NewV1().String())
+	got, err = getUserID(uuid.NewV1().String())
 	assert.NoError(t, err, "should not have error to get non-exsted userid")
-	assert.EqualValues(t, 0, userid, "userid should be 0 when not exist")
+	assert.EqualValues(t, 0, got.userid, "userid should be 0 when not exist")
+}
+
+func testSweepLeader(t *testing.T) {
+	key := advisoryKey(testTableName + "_leader")
+	assert.Equal(t, key, advisoryKey(testTableName+"_leader"), "key should be the same for a table")
+	assert.NotEqual(t, key, advisoryKey(testTableName), "key should be different for another table")
+
+	l1 := &sweepLeader{key: key}
+	l2 := &sweepLeader{key: key}
+
+	ok, err := l1.elect()
+	assert.NoError(t, err, "should not have error to elect")
+	assert.True(t, ok, "the first one should be the leader")
+	ok, err = l2.elect()
+	assert.NoError(t, err, "should not have error to elect")
+	assert.False(t, ok, "only one should be the leader while sweeping")
+	assert.Nil(t, l2.conn, "the connection should be released when not leading")
+
+	// the sweep is done
+	l1.resign()
+	assert.Nil(t, l1.conn, "the connection should be released after the sweep")
+	ok, err = l2.elect()
+	assert.NoError(t, err, "should not have error to elect")
+	assert.True(t, ok, "another one should lead after the sweep")
+
+	// the leader dies while sweeping
+	l2.conn.Close()
+	l2.resign()
+	ok, err = l1.elect()
+	assert.NoError(t, err, "should not have error to elect")
+	assert.True(t, ok, "another one should take over")
+	l1.resign()
+}
+
+func testSweepBatches(t *testing.T) {
+	now := time.Now().Unix()
+	var tokens []string
+	for i := 0; i < 5; i++ {
+		tkInfo := &TokenInfo{
+			Token:    uuid.NewV4().String(),
+			UserID:   34,
+			CreateAt: int32(now),
+			LastUse:  int32(now),
+			ExpireAt: int32(now),
+		}
+		assert.NoError(t, setToken(tkInfo), "should not have error to set token")
+		tokens = append(tokens, tkInfo.Token)
+	}
+
+	var events []Event
+	SetObserver(func(e Event) {
+		if e.Kind == EventSweep || e.Kind == EventSweepDone {
+			events = append(events, e)
+		}
+	})
+	defer SetObserver(nil)
+
+	dbSweepBatch = 2
+	defer func() { dbSweepBatch = 1000 }()
+	stopped := sweepExpired(dbPool, delExpiredSQL(testTableName), 0, now)
+	assert.False(t, stopped, "should not be stopped")
+
+	if assert.True(t, len(events) >= 3, "should have progress events") {
+		assert.Equal(t, EventSweep, events[0].Kind, "event wrong")
+		assert.Equal(t, 2, events[0].Count, "deleted count wrong")
+		assert.Equal(t, EventSweep, events[1].Kind, "event wrong")
+		assert.Equal(t, 4, events[1].Count, "deleted count wrong")
+		last := events[len(events)-1]
+		assert.Equal(t, EventSweepDone, last.Kind, "event wrong")
+		assert.True(t, last.Count >= 5, "deleted count wrong")
+	}
+	for _, tk := range tokens {
+		got, err := getUserID(tk)
+		assert.NoError(t, err, "should not have error to get user id")
+		assert.Equal(t, int32(0), got.userid, "expired token should be deleted")
+	}
+}
+
+func testFlushBatches(t *testing.T) {
+	userid := int32(42)
+	now := int32(time.Now().Unix())
+	tokens := makeFlushTokens(t, userid, 5, now)
+	latests := make([]tokenLatest, len(tokens))
+	for i := range latests {
+		latests[i] = tokenLatest{lastUse: now + int32(i) + 1, uses: int64(i) + 1, firstUse: now, lastIP: "10.0.0.1"}
+	}
+	// not existed token is ignored
+	tokens = append(tokens, uuid.NewV4().String())
+	latests = append(latests, tokenLatest{lastUse: now})
+	// malformed token doesn't fail the batch
+	tokens = append(tokens, "not-a-token")
+	latests = append(latests, tokenLatest{lastUse: now})
+
+	dbFlushBatch = 2
+	defer func() { dbFlushBatch = 1000 }()
+	n, err := flushTokens(tokens, latests)
+	assert.NoError(t, err, "should not have error to flush tokens")
+	assert.Equal(t, len(tokens), n, "all should be flushed")
+
+	got, err := getAllTokens(userid)
+	assert.NoError(t, err, "should not have error to get all tokens")
+	assert.Len(t, got, 5, "all tokens length wrong")
+	for _, one := range got {
+		for i := range tokens {
+			if cleanToken(tokens[i]) == one.Token {
+				assert.Equal(t, latests[i].lastUse, one.LastUse, "last_use wrong")
+				assert.Equal(t, latests[i].uses, one.UseCount, "use_count wrong")
+				assert.Equal(t, now, one.FirstUse, "first_use wrong")
+				assert.Equal(t, "10.0.0.1", one.LastIP, "last_ip wrong")
+			}
+		}
+	}
+
+	_, _, err = delUserTokens(userid, "")
+	assert.NoError(t, err, "should not have error to delete tokens")
+}
+
+// makeFlushTokens to set n tokens of the user to DB.
+func makeFlushTokens(tb testing.TB, userid int32, n int, now int32) []string {
+	tokens := make([]string, n)
+	for i := range tokens {
+		tkInfo := &TokenInfo{
+			Token:    uuid.NewV4().String(),
+			UserID:   userid,
+			CreateAt: now,
+			LastUse:  now,
+		}
+		if err := setToken(tkInfo); err != nil {
+			tb.Fatal(err)
+		}
+		tokens[i] = tkInfo.Token
+	}
+	return tokens
+}
+
+var benchOnce sync.Once
+
+// benchFlush to make the tokens to flush, the module is used by the first benchmark.
+func benchFlush(b *testing.B, userid int32) ([]string, []tokenLatest) {
+	benchOnce.Do(func() {
+		if _, err := Use(getDBInfo(b), getRDSInfo(b), nil); err != nil {
+			b.Fatal(err)
+		}
+	})
+
+	now := int32(time.Now().Unix())
+	tokens := makeFlushTokens(b, userid, 1000, now)
+	latests := make([]tokenLatest, len(tokens))
+	for i := range latests {
+		latests[i] = tokenLatest{lastUse: now, uses: 1, firstUse: now}
+	}
+	return tokens, latests
+}
+
+func BenchmarkFlushOneByOne(b *testing.B) {
+	tokens, latests := benchFlush(b, 43)
+	defer delUserTokens(43, "")
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := range tokens {
+			if err := updateToken(tokens[i], latests[i]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkFlushBatch(b *testing.B) {
+	tokens, latests := benchFlush(b, 44)
+	defer delUserTokens(44, "")
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := flushTokens(tokens, latests); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
 
 func testEXPCheck(t *testing.T) {
@@ -61,13 +246,15 @@ func testEXPCheck(t *testing.T) {
 	assert.NoError(t, err, "should not have error to set token")
 
 	dbPersistentSecond = 1
-	go startDBEXPCheck(2, testTableName)
+	goWorker(func() {
+		startDBEXPCheck(2, testTableName)
+	})
 	time.Sleep(2100 * time.Millisecond)
 
 	// after 2 second and check
-	gotUserid, err := getUserID(tk)
+	got, err := getUserID(tk)
 	assert.NoError(t, err, "should not have error to get user id")
-	assert.Equal(t, int32(0), gotUserid, "userid result wrong")
+	assert.Equal(t, int32(0), got.userid, "userid result wrong")
 }
 
 func testCRUD(t *testing.T) {
@@ -97,34 +284,34 @@ func testCRUD(t *testing.T) {
 	assert.Error(t, err, "should have error to set an invalid token")
 
 	// should be ok to get userid
-	gotUserid, err := getUserID(tk)
+	got, err := getUserID(tk)
 	assert.NoError(t, err, "should not have error to get user id")
-	assert.Equal(t, userid, gotUserid, "userid result wrong")
+	assert.Equal(t, userid, got.userid, "userid result wrong")
 
 	// should be ok to get even after dbPersistentSecond set
 	dbPersistentSecond = 2
-	gotUserid, err = getUserID(tk)
+	got, err = getUserID(tk)
 	assert.NoError(t, err, "should not have error to get user id")
-	assert.Equal(t, userid, gotUserid, "userid result wrong")
+	assert.Equal(t, userid, got.userid, "userid result wrong")
 
 	// token should be invalid after 2 second
 	time.Sleep(2 * time.Second)
-	gotUserid, err = getUserID(tk)
+	got, err = getUserID(tk)
 	assert.NoError(t, err, "should not have error to get user id")
-	assert.Equal(t, int32(0), gotUserid, "userid result wrong")
+	assert.Equal(t, int32(0), got.userid, "userid result wrong")
 
 	// update last_use
 	now = int32(time.Now().Unix())
-	err = updateToken(tk, now)
+	err = updateToken(tk, tokenLatest{lastUse: now})
 	assert.NoError(t, err, "should not have error to update token")
 
 	// the userid should be valid again
-	gotUserid, err = getUserID(tk)
+	got, err = getUserID(tk)
 	assert.NoError(t, err, "should not have error to get user id")
-	assert.Equal(t, userid, gotUserid, "userid result wrong")
+	assert.Equal(t, userid, got.userid, "userid result wrong")
 
 	// update a non-existed token
-	err = updateToken(uuid.NewV1().String(), now)
+	err = updateToken(uuid.NewV1().String(), tokenLatest{lastUse: now})
 	assert.NoError(t, err, "should not have error to update a non-existed token")
 
 	// get all tokens of a user
@@ -139,11 +326,109 @@ func testCRUD(t *testing.T) {
 	assert.Len(t, tokens, 0, "all tokens length wrong")
 
 	// delete
-	err = delToken(tk)
+	_, _, err = delToken(tk, "")
 	assert.NoError(t, err, "should not have error to delete token")
 
 	// the userid should not exist after delete.
-	gotUserid, err = getUserID(tk)
+	got, err = getUserID(tk)
 	assert.NoError(t, err, "should not have error to get user id")
-	assert.Equal(t, int32(0), gotUserid, "userid result wrong")
+	assert.Equal(t, int32(0), got.userid, "userid result wrong")
+}
+
+func testInfoWhere(t *testing.T) {
+	_, _, err := infoWhere(nil)
+	assert.Error(t, err, "should have error without filters")
+
+	_, _, err = infoWhere([]InfoFilter{{Key: "device", Op: "~", Value: "ios"}})
+	assert.Error(t, err, "should have error with invalid operator")
+
+	_, _, err = infoWhere([]InfoFilter{{Op: "=", Value: "ios"}})
+	assert.Error(t, err, "should have error without key")
+
+	where, args, err := infoWhere([]InfoFilter{
+		{Key: "device", Op: "=", Value: "android"},
+		{Key: "app_version", Op: "<", Value: 3.2},
+	})
+	assert.NoError(t, err, "should not have error to build filters")
+	assert.Equal(t, "info @> $1 AND (jsonb_typeof(info->$2::text)=jsonb_typeof($3::jsonb) AND info->$2::text < $3::jsonb)", where, "where wrong")
+	assert.Equal(t, []interface{}{map[string]interface{}{"device": "android"}, "app_version", "3.2"}, args, "args wrong")
+}
+
+func testCursor(t *testing.T) {
+	tk := uuid.NewV4().String()
+	value, token, err := decodeCursor(encodeCursor(123, tk))
+	assert.NoError(t, err, "should not have error to decode cursor")
+	assert.Equal(t, int32(123), value, "cursor value wrong")
+	assert.Equal(t, tk, token, "cursor token wrong")
+
+	_, _, err = decodeCursor("abc")
+	assert.Error(t, err, "should have error with invalid cursor")
+}
+
+func testTokensPage(t *testing.T) {
+	userid := int32(31)
+	now := int32(time.Now().Unix())
+	dbPersistentSecond = 0
+
+	// 5 tokens created one second after another, the last one expired
+	var tks []string
+	for i := 0; i < 5; i++ {
+		tkInfo := &TokenInfo{
+			Token:    cleanToken(uuid.NewV4().String()),
+			UserID:   userid,
+			CreateAt: now - 10 + int32(i),
+			LastUse:  now - int32(i),
+		}
+		if i == 4 {
+			tkInfo.ExpireAt = now - 1
+		}
+		if i == 3 {
+			tkInfo.Parent = tks[0]
+		}
+		err := setToken(tkInfo)
+		assert.NoError(t, err, "should not have error to set token")
+		tks = append(tks, tkInfo.Token)
+	}
+
+	// page by create_at
+	var got []string
+	q := &PageQuery{Limit: 2}
+	for i := 0; i < 3; i++ {
+		page, err := getTokensPage(userid, q)
+		assert.NoError(t, err, "should not have error to get page")
+		assert.Equal(t, 5, page.Total, "total wrong")
+		for _, one := range page.Tokens {
+			got = append(got, one.Token)
+		}
+		q.Cursor = page.NextCursor
+	}
+	assert.Equal(t, tks, got, "tokens wrong when paging")
+	assert.Equal(t, "", q.Cursor, "should have no more page")
+
+	// the most recently used first
+	page, err := getTokensPage(userid, &PageQuery{Limit: 2, SortBy: SortLastUse, Desc: true})
+	assert.NoError(t, err, "should not have error to get page")
+	assert.Equal(t, tks[:2], []string{page.Tokens[0].Token, page.Tokens[1].Token}, "tokens wrong when sorted by last_use")
+	assert.NotEqual(t, "", page.NextCursor, "should have next page")
+
+	// filters
+	page, err = getTokensPage(userid, &PageQuery{ActiveOnly: true})
+	assert.NoError(t, err, "should not have error to get page")
+	assert.Equal(t, 4, page.Total, "active total wrong")
+	assert.Len(t, page.Tokens, 4, "active tokens wrong")
+
+	page, err = getTokensPage(userid, &PageQuery{Kind: KindChild})
+	assert.NoError(t, err, "should not have error to get page")
+	assert.Equal(t, 1, page.Total, "child total wrong")
+	assert.Equal(t, tks[3], page.Tokens[0].Token, "child token wrong")
+
+	_, err = getTokensPage(userid, &PageQuery{Cursor: "abc"})
+	assert.Error(t, err, "should have error with invalid cursor")
+
+	_, _, err = delToken(tks[0], "")
+	assert.NoError(t, err, "should not have error to delete token")
+	for _, tk := range tks[1:] {
+		_, _, err = delToken(tk, "")
+		assert.NoError(t, err, "should not have error to delete token")
+	}
 }
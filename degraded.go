@@ -0,0 +1,231 @@
+package kktoken
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/jackc/pgx"
+)
+
+// the Redis list of the usage not flushed to DB, when the queue in map is full
+const rdsFlushKey = "kktoken:flush"
+
+// the usage of a token waiting to be flushed to DB
+type flushEntry struct {
+	Token     string `json:"t"`
+	LastUse   int32  `json:"l"`
+	LastIP    string `json:"i,omitempty"`
+	LastAgent string `json:"a,omitempty"`
+	Uses      int64  `json:"n,omitempty"`
+	FirstUse  int32  `json:"f,omitempty"`
+}
+
+// the usage waiting to be flushed to DB
+type flushStore struct {
+	all  map[string]tokenLatest
+	lock *sync.Mutex
+}
+
+var (
+	// ErrDegraded means DB is not available, only the tokens in map and Redis can be got.
+	ErrDegraded = errors.New("database unavailable")
+
+	dbBreaker *circuitBreaker
+	// How many tokens are updated in one statement
+	dbFlushBatch = 1000
+	// How many tokens can wait in map to be flushed to DB, the others wait in Redis
+	dbQueueSize = uint32(10000)
+
+	allFlush = flushStore{
+		all:  make(map[string]tokenLatest),
+		lock: new(sync.Mutex),
+	}
+)
+
+// isDBDown to check whether the error means DB is not available.
+func isDBDown(err error) bool {
+	if err == nil || err == pgx.ErrNoRows {
+		return false
+	}
+	// an error from the server means DB is still there
+	_, ok := err.(pgx.PgError)
+	return !ok
+}
+
+// reportDB to report the result of using DB to the circuit breaker.
+func reportDB(err error) error {
+	dbBreaker.report(isDBDown(err))
+	return err
+}
+
+// pingDB to check whether DB is back.
+func pingDB() error {
+	_, err := dbPool.Exec("SELECT 1")
+	return err
+}
+
+// flushTokens to update the usage of unique tokens to DB in batches, or queue them while DB is not available.
+// It returns how many from the start are updated or queued, the others are not if error.
+func flushTokens(tokens []string, latests []tokenLatest) (int, error) {
+	for start := 0; start < len(tokens); start += dbFlushBatch {
+		end := start + dbFlushBatch
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+
+		if dbBreaker.allow() {
+			err := updateTokens(tokens[start:end], latests[start:end])
+			if err == nil {
+				continue
+			} else if !isDBDown(err) {
+				return start, err
+			}
+		}
+		for i := start; i < end; i++ {
+			if err := queueFlush(tokens[i], latests[i]); err != nil {
+				return i, err
+			}
+		}
+	}
+	return len(tokens), nil
+}
+
+// mergeUsage to add the usage of a later one to one.
+func mergeUsage(one *tokenLatest, later tokenLatest) {
+	if later.lastUse > one.lastUse {
+		one.lastUse = later.lastUse
+	}
+	if later.firstUse > 0 && (one.firstUse == 0 || later.firstUse < one.firstUse) {
+		one.firstUse = later.firstUse
+	}
+	if later.lastIP != "" {
+		one.lastIP = later.lastIP
+	}
+	if later.lastAgent != "" {
+		one.lastAgent = later.lastAgent
+	}
+	one.uses += later.uses
+}
+
+// queueFlush to keep the usage in map, or in Redis if the queue is full.
+func queueFlush(token string, one tokenLatest) error {
+	allFlush.lock.Lock()
+	if old, ok := allFlush.all[token]; ok {
+		mergeUsage(&old, one)
+		allFlush.all[token] = old
+		allFlush.lock.Unlock()
+		return nil
+	}
+	if uint32(len(allFlush.all)) < dbQueueSize {
+		allFlush.all[token] = one
+		allFlush.lock.Unlock()
+		return nil
+	}
+	allFlush.lock.Unlock()
+
+	return spillFlush(token, one)
+}
+
+// spillFlush to keep the usage in Redis.
+func spillFlush(token string, one tokenLatest) error {
+	value, err := json.Marshal(flushEntry{
+		Token:     token,
+		LastUse:   one.lastUse,
+		LastIP:    one.lastIP,
+		LastAgent: one.lastAgent,
+		Uses:      one.uses,
+		FirstUse:  one.firstUse,
+	})
+	if err != nil {
+		return err
+	}
+
+	conn, err := rdsGet()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("RPUSH", rdsFlushKey, value)
+	return err
+}
+
+// popFlush to get a usage kept in Redis, empty token if nothing left.
+func popFlush() (string, tokenLatest, error) {
+	conn, err := rdsGet()
+	if err != nil {
+		return "", tokenLatest{}, err
+	}
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("LPOP", rdsFlushKey))
+	if err == redis.ErrNil {
+		return "", tokenLatest{}, nil
+	}
+	if err != nil {
+		return "", tokenLatest{}, err
+	}
+
+	var entry flushEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return "", tokenLatest{}, err
+	}
+	return entry.Token, tokenLatest{
+		lastUse:   entry.LastUse,
+		lastIP:    entry.LastIP,
+		lastAgent: entry.LastAgent,
+		uses:      entry.Uses,
+		firstUse:  entry.FirstUse,
+	}, nil
+}
+
+// replayFlush to flush the usage queued while DB was not available.
+// The ones failed while DB is down again are queued again, the others are retried later.
+func replayFlush() {
+	allFlush.lock.Lock()
+	all := allFlush.all
+	allFlush.all = make(map[string]tokenLatest)
+	allFlush.lock.Unlock()
+	replayTokens(all)
+
+	// stop if DB is down again, or they'll be spilled back
+	for dbBreaker.allow() {
+		// the same token might be spilled more than once
+		all = make(map[string]tokenLatest)
+		for len(all) < dbFlushBatch {
+			token, one, err := popFlush()
+			if err != nil {
+				replayTokens(all)
+				sendError(err)
+				return
+			} else if token == "" {
+				replayTokens(all)
+				return
+			}
+
+			if old, ok := all[token]; ok {
+				mergeUsage(&old, one)
+				one = old
+			}
+			all[token] = one
+		}
+		replayTokens(all)
+	}
+}
+
+// replayTokens to flush the usage queued, the failed ones are retried later.
+func replayTokens(all map[string]tokenLatest) {
+	tokens := make([]string, 0, len(all))
+	latests := make([]tokenLatest, 0, len(all))
+	for token, one := range all {
+		tokens = append(tokens, token)
+		latests = append(latests, one)
+	}
+
+	n, _ := flushTokens(tokens, latests)
+	for i := n; i < len(tokens); i++ {
+		dbRetry.failed(tokens[i], latests[i], true)
+	}
+}
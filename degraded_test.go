@@ -0,0 +1,76 @@
+package kktoken
+
+import (
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func testDegraded(t *testing.T) {
+	userid := int32(40)
+	tk, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+	other, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+
+	// DB is not available
+	dbBreaker.lock.Lock()
+	dbBreaker.open = true
+	dbBreaker.lock.Unlock()
+	dbQueueSize = 1
+	defer func() {
+		dbQueueSize = 10000
+	}()
+
+	gotUserID, err := GetUserID(tk)
+	assert.NoError(t, err, "should get from map without error")
+	assert.Equal(t, userid, gotUserID, "userid wrong")
+	evictMap([]string{tk})
+	gotUserID, err = GetUserID(tk)
+	assert.NoError(t, err, "should get from redis without error")
+	assert.Equal(t, userid, gotUserID, "userid wrong")
+
+	_, err = GetUserID(cleanToken(uuid.NewV4().String()))
+	assert.Equal(t, ErrDegraded, err, "unknown token should not be checked")
+	_, err = MakeToken(userid, nil)
+	assert.Equal(t, ErrDegraded, err, "should not make token")
+	_, err = MakeChildToken(tk, nil, nil)
+	assert.Equal(t, ErrDegraded, err, "should not make child token")
+
+	// the usage is queued, then spilled to Redis
+	now := int32(time.Now().Unix())
+	n, err := flushTokens([]string{tk}, []tokenLatest{{lastUse: now + 100, uses: 2, firstUse: now}})
+	assert.NoError(t, err, "should queue usage")
+	assert.Equal(t, 1, n, "usage should be queued")
+	n, err = flushTokens([]string{tk, other}, []tokenLatest{{lastUse: now + 50, uses: 3, lastIP: "10.0.0.9"}, {lastUse: now + 100, uses: 1}})
+	assert.NoError(t, err, "should merge and spill usage")
+	assert.Equal(t, 2, n, "usage should be queued or spilled")
+	allFlush.lock.Lock()
+	assert.Equal(t, tokenLatest{lastUse: now + 100, uses: 5, firstUse: now, lastIP: "10.0.0.9"}, allFlush.all[tk], "merged usage wrong")
+	assert.Len(t, allFlush.all, 1, "queue should be bounded")
+	allFlush.lock.Unlock()
+
+	// DB is back
+	dbBreaker.lock.Lock()
+	dbBreaker.open = false
+	dbBreaker.lock.Unlock()
+	replayFlush()
+
+	tokens, err := GetUserTokens(userid)
+	assert.NoError(t, err, "should not have error to get tokens")
+	for _, one := range tokens {
+		assert.Equal(t, now+100, one.LastUse, "last_use should be replayed")
+		if one.Token == tk {
+			assert.Equal(t, int64(5), one.UseCount, "use count should be replayed")
+			assert.Equal(t, "10.0.0.9", one.LastIP, "last_ip should be replayed")
+		}
+	}
+	token, _, err := popFlush()
+	assert.NoError(t, err, "should not have error to pop")
+	assert.Equal(t, "", token, "nothing should be left in redis")
+
+	assert.NoError(t, DelToken(tk), "should not have error to delete token")
+	assert.NoError(t, DelToken(other), "should not have error to delete token")
+}
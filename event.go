@@ -0,0 +1,79 @@
+package kktoken
+
+import (
+	"sync"
+	"time"
+)
+
+// EventKind the kind of an event.
+type EventKind string
+
+const (
+	// EventBindingMismatch means a token is used by a client not matching its binding.
+	EventBindingMismatch EventKind = "binding_mismatch"
+	// EventSuspend means all the tokens of a user are suspended.
+	EventSuspend EventKind = "suspend"
+	// EventResume means the tokens of a suspended user are accepted again.
+	EventResume EventKind = "resume"
+	// EventBusUp means the revocations from other processes are received, the Detail is the bus.
+	EventBusUp EventKind = "bus_up"
+	// EventBusDown means the revocations from other processes might be missed, the Detail is the bus.
+	EventBusDown EventKind = "bus_down"
+	// EventLeader means this process becomes the one deleting expired tokens in DB, the Detail is the table.
+	EventLeader EventKind = "leader"
+	// EventLeaderLost means this process is not the one deleting expired tokens in DB anymore, the Detail is the table.
+	EventLeaderLost EventKind = "leader_lost"
+	// EventSweep means a batch of expired tokens is deleted from DB and there are more, the Count is how many deleted so far.
+	EventSweep EventKind = "sweep"
+	// EventSweepDone means the expired tokens are deleted from DB, the Count is how many deleted.
+	EventSweepDone EventKind = "sweep_done"
+	// EventLockout means a client failed too many lookups and is locked out, the Detail is like "ip:10.0.0.1".
+	EventLockout EventKind = "lockout"
+	// EventBreakerOpen means a tier failed too many times and is skipped, the Detail is the tier like "redis".
+	EventBreakerOpen EventKind = "breaker_open"
+	// EventBreakerClose means a skipped tier is back, the Detail is the tier like "redis".
+	EventBreakerClose EventKind = "breaker_close"
+	// EventRetryDrop means a background write failed too many times and is given up, the Detail is the tier like "redis",
+	// the Count is how many times it's tried.
+	EventRetryDrop EventKind = "retry_drop"
+)
+
+// Event something happened inside kktoken, sent to the observer.
+type Event struct {
+	Kind   EventKind
+	Token  string
+	UserID int32
+	// more about the event, like the mismatched field of a binding
+	Detail string
+	// how many records, like the deleted ones of a sweep
+	Count int
+	At    int32
+}
+
+var (
+	observer     func(Event)
+	observerLock = new(sync.RWMutex)
+)
+
+// SetObserver to set the function receiving events, nil to stop receiving.
+// The function is called synchronously, so it should return quickly.
+func SetObserver(fn func(Event)) {
+	observerLock.Lock()
+	observer = fn
+	observerLock.Unlock()
+}
+
+// emit to send the event to the observer if there is one.
+func emit(e Event) {
+	observerLock.RLock()
+	fn := observer
+	observerLock.RUnlock()
+
+	if fn == nil {
+		return
+	}
+	if e.At == 0 {
+		e.At = int32(time.Now().Unix())
+	}
+	fn(e)
+}
@@ -0,0 +1,55 @@
+package kktoken
+
+import (
+	"errors"
+	"sync"
+)
+
+// the error the waiting callers get when the lookup in flight panics
+var errFlightPanic = errors.New("lookup in flight panicked")
+
+// a lookup in flight
+type flightCall struct {
+	wg  sync.WaitGroup
+	one tokenLatest
+	err error
+}
+
+// flightGroup to share the result of a lookup with all the callers looking up the same token at the same time.
+type flightGroup struct {
+	calls map[string]*flightCall
+	lock  *sync.Mutex
+}
+
+// the lookups of tokens in DB
+var dbFlight = flightGroup{
+	calls: make(map[string]*flightCall),
+	lock:  new(sync.Mutex),
+}
+
+// do to run fn for the token if not in flight, or wait for the one in flight.
+// Return the result, and whether it's shared from another caller.
+func (g *flightGroup) do(token string, fn func() (tokenLatest, error)) (tokenLatest, bool, error) {
+	g.lock.Lock()
+	if c, ok := g.calls[token]; ok {
+		g.lock.Unlock()
+		c.wg.Wait()
+		return c.one, true, c.err
+	}
+	c := new(flightCall)
+	c.wg.Add(1)
+	g.calls[token] = c
+	g.lock.Unlock()
+
+	// the waiting callers are released even if fn panics
+	defer func() {
+		c.wg.Done()
+		g.lock.Lock()
+		delete(g.calls, token)
+		g.lock.Unlock()
+	}()
+
+	c.err = errFlightPanic
+	c.one, c.err = fn()
+	return c.one, false, c.err
+}
@@ -0,0 +1,72 @@
+package kktoken
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testFlightGroup(t *testing.T) {
+	g := flightGroup{
+		calls: make(map[string]*flightCall),
+		lock:  new(sync.Mutex),
+	}
+
+	var calls int32
+	var shared int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			one, ok, err := g.do("tk", func() (tokenLatest, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(100 * time.Millisecond)
+				return tokenLatest{userid: 5}, nil
+			})
+			assert.NoError(t, err, "should not have error")
+			assert.Equal(t, int32(5), one.userid, "shared userid wrong")
+			if ok {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), calls, "should only run once")
+	assert.Equal(t, int32(9), shared, "should be shared with other callers")
+
+	// run again after finished
+	_, ok, err := g.do("tk", func() (tokenLatest, error) {
+		return tokenLatest{}, errors.New("failed")
+	})
+	assert.Error(t, err, "should get the error")
+	assert.False(t, ok, "should not be shared")
+	assert.Len(t, g.calls, 0, "no call should be in flight")
+
+	// the waiting caller is released when the lookup panics
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer func() {
+			recover()
+			close(done)
+		}()
+		g.do("tk", func() (tokenLatest, error) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			panic("lookup")
+		})
+	}()
+	<-started
+	_, ok, err = g.do("tk", func() (tokenLatest, error) {
+		return tokenLatest{userid: 5}, nil
+	})
+	assert.True(t, ok, "should wait for the lookup in flight")
+	assert.Equal(t, errFlightPanic, err, "should get the error of the panic")
+	<-done
+	assert.Len(t, g.calls, 0, "no call should be in flight after the panic")
+}
@@ -0,0 +1,83 @@
+package kktoken
+
+import (
+	"fmt"
+)
+
+// the columns moved to the history table
+const historyColumns = "token,user_id,info,create_at,last_use,parent,expire_at,scopes,last_ip,last_agent,use_count,first_use,binding"
+
+var (
+	dbHistorySecond uint32
+	purgeHistoryStm string
+)
+
+// prepareHistory to create the history table and statements.
+func prepareHistory(tableName string, seconds uint32) error {
+	s := `CREATE TABLE IF NOT EXISTS %s_history (
+	token UUID NOT NULL,
+	user_id INTEGER NOT NULL,
+	info JSONB,
+	create_at INTEGER NOT NULL,
+	last_use INTEGER NOT NULL,
+	parent UUID,
+	expire_at INTEGER NOT NULL,
+	scopes TEXT[] NOT NULL,
+	last_ip TEXT NOT NULL,
+	last_agent TEXT NOT NULL,
+	use_count BIGINT NOT NULL,
+	first_use INTEGER NOT NULL,
+	binding JSONB,
+	state TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	remove_at INTEGER NOT NULL);`
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName)); err != nil {
+		return err
+	}
+
+	// add the column for the client binding to the history created before
+	s = "ALTER TABLE %s_history ADD COLUMN IF NOT EXISTS binding JSONB;"
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName)); err != nil {
+		return err
+	}
+
+	// create index if not exist for user_id to find the history of a user
+	s = "CREATE INDEX IF NOT EXISTS %s_history_user_id_index ON %s_history USING btree (user_id);"
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName, tableName)); err != nil {
+		return err
+	}
+
+	// create index if not exist for remove_at to purge the history
+	s = "CREATE INDEX IF NOT EXISTS %s_history_remove_at_index ON %s_history USING btree (remove_at);"
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName, tableName)); err != nil {
+		return err
+	}
+
+	purgeHistoryStm = fmt.Sprintf("DELETE FROM %s_history WHERE remove_at < $1", tableName)
+	dbHistorySecond = seconds
+	return nil
+}
+
+// archiveSQL to get the part of a statement moving the rows returned by the "deleted" query to the history table.
+// The state, reason and removeAt are SQL expressions.
+func archiveSQL(tableName, state, reason, removeAt string) string {
+	return fmt.Sprintf(`archived AS (INSERT INTO %s_history(%s,state,reason,remove_at)
+	SELECT %s,%s,%s,%s FROM deleted)`, tableName, historyColumns, historyColumns, state, reason, removeAt)
+}
+
+// historyArgs to add the reason to the arguments of deleteTreeSQL if the history is enabled.
+func historyArgs(args []interface{}, reason string) []interface{} {
+	if dbHistorySecond == 0 {
+		return args
+	}
+	return append(args, reason)
+}
+
+// purgeHistory to delete the history older than the retention.
+func purgeHistory(db dbRunner, now int64) error {
+	if dbHistorySecond == 0 {
+		return nil
+	}
+	_, err := db.Exec(purgeHistoryStm, now-int64(dbHistorySecond))
+	return err
+}
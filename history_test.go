@@ -0,0 +1,83 @@
+package kktoken
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func testHistory(t *testing.T) {
+	err := prepareHistory(testTableName, 100)
+	assert.NoError(t, err, "should not have error to prepare history")
+	deleteTokenStm = deleteTreeSQL("token=$1", 1)
+	defer func() {
+		dbHistorySecond = 0
+		deleteTokenStm = deleteTreeSQL("token=$1", 1)
+	}()
+	testTableGeneration(testTableName+"_history", t)
+
+	userid := int32(35)
+	tk, err := MakeToken(userid, map[string]interface{}{"device": "ios"})
+	assert.NoError(t, err, "should not have error to make token")
+	child, err := MakeChildToken(tk, nil, nil)
+	assert.NoError(t, err, "should not have error to make child token")
+
+	// revoked with the child
+	err = RevokeToken(tk, "password_changed", nil)
+	assert.NoError(t, err, "should not have error to revoke token")
+
+	// expired by EXPCheck
+	now := time.Now().Unix()
+	tkInfo := &TokenInfo{
+		Token:    uuid.NewV4().String(),
+		UserID:   userid,
+		CreateAt: int32(now),
+		LastUse:  int32(now),
+		ExpireAt: int32(now + 1),
+		binding:  &clientBinding{CIDR: "10.0.0.0/8"},
+	}
+	err = setToken(tkInfo)
+	assert.NoError(t, err, "should not have error to set token")
+	expiredChild, err := MakeChildToken(tkInfo.Token, nil, nil)
+	assert.NoError(t, err, "should not have error to make child token")
+	_, err = delExpired(dbPool, delExpiredSQL(testTableName), 0, now+1)
+	assert.NoError(t, err, "should not have error to delete expired tokens")
+
+	s := fmt.Sprintf("SELECT token::text,state,reason,info FROM %s_history WHERE user_id=$1", testTableName)
+	rows, _ := dbPool.Query(s, userid)
+	got := make(map[string][]string)
+	var info map[string]interface{}
+	for rows.Next() {
+		var token, state, reason string
+		var one map[string]interface{}
+		assert.NoError(t, rows.Scan(&token, &state, &reason, &one), "should not have error to scan history")
+		got[cleanToken(token)] = []string{state, reason}
+		if cleanToken(token) == tk {
+			info = one
+		}
+	}
+	assert.NoError(t, rows.Err(), "should not have error to query history")
+
+	assert.Len(t, got, 4, "should have 4 tokens in history")
+	assert.Equal(t, []string{string(StateRevoked), "password_changed"}, got[tk], "history of token wrong")
+	assert.Equal(t, []string{string(StateRevoked), "password_changed"}, got[child], "history of child wrong")
+	assert.Equal(t, []string{string(StateExpiredAbsolute), ""}, got[cleanToken(tkInfo.Token)], "history of expired token wrong")
+	assert.Contains(t, got, expiredChild, "child of expired token should be in history")
+	assert.Equal(t, "ios", info["device"], "info should be kept in history")
+	var binding clientBinding
+	s = fmt.Sprintf("SELECT binding FROM %s_history WHERE token=$1", testTableName)
+	assert.NoError(t, dbPool.QueryRow(s, tkInfo.Token).Scan(&binding), "should not have error to get binding in history")
+	assert.Equal(t, "10.0.0.0/8", binding.CIDR, "binding should be kept in history")
+
+	// purge after retention
+	err = purgeHistory(dbPool, now+200)
+	assert.NoError(t, err, "should not have error to purge history")
+	var count int
+	s = fmt.Sprintf("SELECT COUNT(*) FROM %s_history WHERE user_id=$1", testTableName)
+	err = dbPool.QueryRow(s, userid).Scan(&count)
+	assert.NoError(t, err, "should not have error to count history")
+	assert.Equal(t, 0, count, "history should be purged")
+}
@@ -1,7 +1,9 @@
 package kktoken
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"strings"
 	"sync"
 	"time"
@@ -17,31 +19,175 @@ type MapInfo struct {
 	// EXPCheck will delete expired tokens in map and update the last_use both in redis and DB.
 	// Beware that this should smaller than RDSLiveSecond
 	EXPCheckSecond uint32
+	// How many seconds a token will live in map while RDSInfo.Channel is not subscribed, default: 5
+	// The revocations by other processes might be missed during that time.
+	DownLiveSecond uint32
+	// How many seconds a token not found will be remembered in map, 0 means disabled, default: 0
+	// Other processes forget it when it's made with RDSInfo.Channel or DBInfo.NotifyChannel set.
+	NegativeSecond uint32
+	// How many tokens not found can be remembered in map at most, default: 10000
+	// When full, a random one is forgotten for the new one.
+	NegativeSize uint32
+	// How many tokens the Bloom filter is sized for at least, 0 means disabled, default: 0
+	// The filter rejects unknown tokens before Redis and DB, it needs RDSInfo.Channel or DBInfo.NotifyChannel
+	// to know the tokens made by other processes, and is not used while they're not subscribed.
+	BloomCapacity uint32
+	// The false positive rate of the Bloom filter, default: 0.01
+	BloomFPRate float64
+	// How many seconds to rebuild the Bloom filter from DB to drop the deleted tokens, default: 3600
+	BloomRebuildSecond uint32
+	// How many times the last_use update to DB or the cache refresh to Redis is tried before given up, default: 5
+	// The failed ones are retried in the background with exponential backoff.
+	RetryLimit uint32
+	// How many milliseconds before the first retry, doubled every retry, default: 500
+	RetryBaseMillisecond uint32
+	// How many seconds the backoff between retries can be at most, default: 60
+	RetryMaxSecond uint32
+	// About how many tokens can be in map at most, 0 means no limit, default: 0
+	// It's approximate: the map is split into 64 shards each limited to MaxEntries/64 rounded up, at least one,
+	// so 10 allows 64 tokens, and a shard can evict before the map has MaxEntries when the tokens are not spread evenly.
+	// When a shard is full, the least recently used ones in it are evicted and their last_use is updated to DB by the next EXPCheck,
+	// or at once when 1000 evicted tokens are waiting.
+	MaxEntries uint32
+}
+
+// TokenOptions the optional settings when making a token
+type TokenOptions struct {
+	// How many seconds a token can live since created no matter how often it is used, 0 means no limit.
+	// A child token never outlives its parent.
+	LiveSecond uint32
+	// The permissions granted to the token, supporting wildcard like "orders:*".
+	// A child token can only have scopes covered by its parent, nil means the same as the parent.
+	Scopes []string
+	// Tie the token to its client, verified by GetClientUserID.
+	// A child token of a bound parent is bound to the same client, it's only used for the child of an unbound parent.
+	Binding *Binding
+	// The reason and the meta like who made the token, written to the audit table with the create event.
+	Reason string
+	Meta   map[string]interface{}
 }
 
 // the latest usage information of token
 type tokenLatest struct {
-	userid  int32
-	lastUse int32
+	userid   int32
+	lastUse  int32
+	expireAt int32
+	scopes   []string
+	binding  *clientBinding
+	// the client of the last use, empty if not known
+	lastIP    string
+	lastAgent string
+	// the uses not flushed to DB yet, and the first of them
+	uses     int64
+	firstUse int32
+	// when it was loaded to map
+	loadAt int32
+	// its slot in the ring of the shard, and whether it's used since the CLOCK hand passed
+	slot       int
+	referenced bool
 }
 
-// the token store
-type tokenStore struct {
+// use to record a use by the client.
+func (one *tokenLatest) use(client *Client) {
+	now := int32(time.Now().Unix())
+	one.lastUse = now
+	one.uses++
+	if one.firstUse == 0 {
+		one.firstUse = now
+	}
+
+	if client == nil {
+		return
+	}
+	if client.IP != nil {
+		one.lastIP = client.IP.String()
+	}
+	if client.UserAgent != "" {
+		one.lastAgent = client.UserAgent
+	}
+}
+
+// how many shards the token store has, each with its own lock
+const mapShards = 64
+
+// a part of the token store
+type tokenShard struct {
 	all  map[string]*tokenLatest
 	lock *sync.RWMutex
+	// the tokens by slot and the CLOCK hand, only used with a limit
+	ring []string
+	hand int
+}
+
+// the token store, sharded by token to spread the lock contention
+type tokenStore struct {
+	shards []tokenShard
+	// how many tokens a shard can have, 0 means no limit
+	limit int
+	// the usage of the tokens evicted when full, flushed to DB by the next EXPCheck
+	evicted flushStore
+}
+
+func newTokenStore(n int) tokenStore {
+	store := tokenStore{
+		shards: make([]tokenShard, n),
+		evicted: flushStore{
+			all:  make(map[string]tokenLatest),
+			lock: new(sync.Mutex),
+		},
+	}
+	for i := range store.shards {
+		store.shards[i] = tokenShard{
+			all:  make(map[string]*tokenLatest),
+			lock: new(sync.RWMutex),
+		}
+	}
+	return store
+}
+
+// shard to get the shard of token by its FNV-1a hash.
+func (s *tokenStore) shard(tk string) *tokenShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(tk); i++ {
+		h ^= uint32(tk[i])
+		h *= 16777619
+	}
+	return &s.shards[h%uint32(len(s.shards))]
+}
+
+// the suspended users synced from Redis
+type suspendStore struct {
+	all  map[int32]bool
+	lock *sync.RWMutex
 }
 
 var (
 	// ErrCache means db is set, while error pop when setting to cache.
 	ErrCache = errors.New("cache not set")
+	// ErrNoParent means the parent token is not found or already expired.
+	ErrNoParent = errors.New("parent token not found")
+	// ErrScopes means the scopes of a child token are not covered by its parent.
+	ErrScopes = errors.New("scopes not covered by parent")
+	// ErrSuspended means the user of the token is suspended.
+	ErrSuspended = errors.New("user suspended")
+	// ErrNoToken means the token is not found.
+	ErrNoToken = errors.New("token not found")
 	// used to get errors from background goroutine
 	errChan = make(chan error)
+	// closed to stop background goroutines
+	quit     = make(chan struct{})
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+	// canceled with quit to stop waiting in background goroutines
+	stopCtx, stopCancel = context.WithCancel(context.Background())
 
 	// this is not the exact seconds because only EXPCheck will check expiration
 	mapLiveSecond = uint32(60)
 
-	allTokens = tokenStore{
-		all:  make(map[string]*tokenLatest),
+	allTokens = newTokenStore(mapShards)
+
+	allSuspended = suspendStore{
+		all:  make(map[int32]bool),
 		lock: new(sync.RWMutex),
 	}
 )
@@ -65,6 +211,25 @@ func Use(dbInfo *DBInfo, rdsInfo *RDSInfo, mapInfo *MapInfo) (chan error, error)
 		return nil, err
 	}
 
+	// DB has all the suspended users in case Redis lost them
+	userids, err := getAllSuspended()
+	if err != nil {
+		return nil, err
+	}
+	if err := addRedisSuspend(userids...); err != nil {
+		return nil, err
+	}
+	if err := syncSuspended(); err != nil {
+		return nil, err
+	}
+
+	// the notifications need Redis to evict tokens
+	if dbNotifyChannel != "" {
+		goWorker(func() {
+			startDBListen(dbNotifyChannel)
+		})
+	}
+
 	mapEXPCheckSecond := uint32(31)
 	if mapInfo != nil {
 		if mapInfo.LiveSecond != 0 {
@@ -73,89 +238,400 @@ func Use(dbInfo *DBInfo, rdsInfo *RDSInfo, mapInfo *MapInfo) (chan error, error)
 		if mapInfo.EXPCheckSecond != 0 {
 			mapEXPCheckSecond = mapInfo.EXPCheckSecond
 		}
+		if mapInfo.DownLiveSecond != 0 {
+			mapDownLiveSecond = mapInfo.DownLiveSecond
+		}
+		mapNegativeSecond = mapInfo.NegativeSecond
+		if mapInfo.NegativeSize != 0 {
+			mapNegativeSize = mapInfo.NegativeSize
+		}
+		mapBloomCapacity = mapInfo.BloomCapacity
+		if mapInfo.BloomFPRate != 0 {
+			mapBloomFPRate = mapInfo.BloomFPRate
+		}
+		if mapInfo.BloomRebuildSecond != 0 {
+			mapBloomRebuildSecond = mapInfo.BloomRebuildSecond
+		}
+		if mapInfo.RetryLimit != 0 {
+			mapRetryLimit = mapInfo.RetryLimit
+		}
+		if mapInfo.RetryBaseMillisecond != 0 {
+			mapRetryBase = time.Duration(mapInfo.RetryBaseMillisecond) * time.Millisecond
+		}
+		if mapInfo.RetryMaxSecond != 0 {
+			mapRetryMax = time.Duration(mapInfo.RetryMaxSecond) * time.Second
+		}
+		allTokens.setLimit(mapInfo.MaxEntries)
+	}
+
+	if mapBloomCapacity > 0 {
+		if err := prepareBloom(); err != nil {
+			return nil, err
+		}
+		goWorker(func() {
+			startBloomRebuild(mapBloomRebuildSecond)
+		})
 	}
 
 	// start the checker for tokens in map
-	go startMapEXPCheck(mapEXPCheckSecond)
+	goWorker(func() {
+		startMapEXPCheck(mapEXPCheckSecond)
+	})
 	return errChan, nil
 }
 
+// Stop to stop all the background goroutines, the uses in map are flushed to DB before returning.
+// The deletion of expired tokens in DB stops after the current batch.
+// The errors after Stop are dropped if errChan is not received anymore.
+func Stop() {
+	stopOnce.Do(func() {
+		close(quit)
+		stopCancel()
+	})
+	workers.Wait()
+}
+
+// goWorker to run fn in a background goroutine, Stop waits for it to return.
+func goWorker(fn func()) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		fn()
+	}()
+}
+
+// sendError to send an error of a background goroutine to errChan.
+// It doesn't block after Stop, the receiver might be gone.
+func sendError(err error) {
+	select {
+	case errChan <- err:
+	case <-quit:
+	}
+}
+
 func startMapEXPCheck(seconds uint32) {
-	c := time.Tick(time.Duration(seconds) * time.Second)
-	for now := range c {
-		var delTokens []string
-		var delLatest []int32
-		var actTokens []string
-		var actIDs []int32
-
-		// get exp threshost
-		exp := now.Unix() - int64(mapLiveSecond)
-
-		// get the expired tokens
-		allTokens.lock.Lock()
-		for k, v := range allTokens.all {
-			if int64(v.lastUse) < exp {
-				// deleted tokens will update DB
-				delTokens = append(delTokens, k)
-				delLatest = append(delLatest, v.lastUse)
+	c := time.NewTicker(time.Duration(seconds) * time.Second)
+	defer c.Stop()
+	r := time.NewTicker(mapRetryBase)
+	defer r.Stop()
+	for {
+		select {
+		case <-quit:
+			// flush the uses for the last time, and try the failed ones once more
+			checkMap(time.Now())
+			retryWrites(time.Time{})
+			return
+		case now := <-c.C:
+			checkMap(now)
+		case <-evictedFlush:
+			flushEvicted()
+		case now := <-r.C:
+			retryWrites(now)
+		}
+	}
+}
+
+// checkMap to delete expired tokens in map, and update the last_use both in redis and DB.
+func checkMap(now time.Time) {
+	allTokens.check(now)
+}
+
+// check to delete expired tokens in the store, and update the last_use both in redis and DB.
+func (s *tokenStore) check(now time.Time) {
+	var delTokens []string
+	var delLatest []tokenLatest
+	var actTokens []string
+	var actLatest []tokenLatest
+	var usedTokens []string
+	var usedLatest []tokenLatest
+
+	// get exp threshost
+	exp := now.Unix() - int64(mapLiveSecond)
+
+	// get the expired tokens, one shard at a time so the lookups of other shards are not blocked
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		for k, v := range shard.all {
+			if v.expireAt > 0 && int64(v.expireAt) <= now.Unix() {
+				// reached the absolute expiration, nothing to update
+				delete(shard.all, k)
+			} else if int64(v.lastUse) < exp {
+				// deleted tokens will update DB if used since the last flush
+				if v.uses > 0 {
+					delTokens = append(delTokens, k)
+					delLatest = append(delLatest, *v)
+				}
+				delete(shard.all, k)
 			} else {
 				// active tokens will update cache
-				actTokens = append(delTokens, k)
-				actIDs = append(actIDs, v.userid)
+				actTokens = append(actTokens, k)
+				actLatest = append(actLatest, *v)
+
+				// and flush the uses since last check to DB
+				if v.uses > 0 {
+					usedTokens = append(usedTokens, k)
+					usedLatest = append(usedLatest, *v)
+					v.uses = 0
+					v.firstUse = 0
+				}
 			}
 		}
-		// delete expired tokens from map
-		if len(delTokens) > 0 {
-			for i := 0; i < len(delTokens); i++ {
-				delete(allTokens.all, delTokens[i])
+		shard.lock.Unlock()
+	}
+
+	// update active tokens in map to redis
+	if len(actTokens) > 0 {
+		err := setRedisCache(actTokens, actLatest)
+		if err == nil {
+			// refreshed, the failed refreshes before are not needed
+			rdsRetry.forget(actTokens)
+		} else if skipOpen(err) != nil {
+			for i := 0; i < len(actTokens); i++ {
+				rdsRetry.failed(actTokens[i], actLatest[i], false)
 			}
 		}
-		allTokens.lock.Unlock()
+	}
 
-		// update active tokens in map to redis
-		if len(actTokens) > 0 {
-			if err := setRedisCache(actTokens, actIDs); err != nil {
-				errChan <- err
-			}
+	// update deleted, used and evicted tokens in map to DB
+	delTokens = append(delTokens, usedTokens...)
+	delLatest = append(delLatest, usedLatest...)
+	evictedTokens, evictedLatest := s.takeEvicted()
+	delTokens, delLatest = mergeEvicted(delTokens, delLatest, evictedTokens, evictedLatest)
+	n, _ := flushTokens(delTokens, delLatest)
+	for i := n; i < len(delTokens); i++ {
+		dbRetry.failed(delTokens[i], delLatest[i], true)
+	}
+
+	// forget the tokens not found long enough
+	purgeMissing(now.Unix())
+	allLocks.purge(now.UnixNano())
+
+	// get the users suspended by other processes
+	if err := syncSuspended(); err != nil {
+		sendError(err)
+	}
+}
+
+// flushEvicted to flush the usage of the tokens evicted from the full map before the next EXPCheck.
+func flushEvicted() {
+	tokens, latests := allTokens.takeEvicted()
+	n, _ := flushTokens(tokens, latests)
+	for i := n; i < len(tokens); i++ {
+		dbRetry.failed(tokens[i], latests[i], true)
+	}
+}
+
+// syncSuspended to replace the suspended users in map with the ones in Redis.
+func syncSuspended() error {
+	userids, found, err := getRedisSuspend()
+	if err != nil {
+		// keep the ones in map while Redis is skipped
+		return skipOpen(err)
+	}
+	if !found {
+		// Redis lost the set, DB has all the suspended users
+		if userids, err = getAllSuspended(); err != nil {
+			return err
 		}
+		if err := resetRedisSuspend(userids); err != nil {
+			return skipOpen(err)
+		}
+	}
+
+	all := make(map[int32]bool, len(userids))
+	for _, userid := range userids {
+		all[userid] = true
+	}
+	allSuspended.lock.Lock()
+	allSuspended.all = all
+	allSuspended.lock.Unlock()
+	return nil
+}
+
+func isSuspended(userid int32) bool {
+	allSuspended.lock.RLock()
+	defer allSuspended.lock.RUnlock()
+	return allSuspended.all[userid]
+}
+
+// getAndSetMap to get the token information from map and update its last_use and client.
+// The userid will be 0 if not found, or it might have been revoked by other processes without being told.
+func getAndSetMap(tk string, client *Client) tokenLatest {
+	return allTokens.getAndSet(tk, client)
+}
+
+// getAndSet to get the token information from the store and update its last_use and client.
+func (s *tokenStore) getAndSet(tk string, client *Client) tokenLatest {
+	shard := s.shard(tk)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	info, ok := shard.all[tk]
+	if !ok {
+		return tokenLatest{}
+	}
+
+	if info.expireAt > 0 && int64(info.expireAt) <= time.Now().Unix() {
+		delete(shard.all, tk)
+		return tokenLatest{}
+	}
+	if mapStale(info.loadAt) {
+		// keep it for the uses not flushed yet
+		return tokenLatest{}
+	}
+	info.use(client)
+	info.referenced = true
+	return *info
+}
+
+// getMap to get the token information from map without using it.
+// The userid will be 0 if not found, like getAndSetMap.
+func getMap(tk string) tokenLatest {
+	return allTokens.get(tk)
+}
+
+// get to get the token information from the store without using it.
+func (s *tokenStore) get(tk string) tokenLatest {
+	shard := s.shard(tk)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+
+	info, ok := shard.all[tk]
+	if !ok || (info.expireAt > 0 && int64(info.expireAt) <= time.Now().Unix()) || mapStale(info.loadAt) {
+		return tokenLatest{}
+	}
+	return *info
+}
+
+// setToMap to set the token to map, the uses not flushed yet in the existing one are kept.
+func setToMap(tk string, one tokenLatest) {
+	allTokens.set(tk, one)
+}
+
+// set to set the token to the store, the uses not flushed yet in the existing one are kept.
+func (s *tokenStore) set(tk string, one tokenLatest) {
+	now := int32(time.Now().Unix())
+	if one.lastUse == 0 {
+		one.lastUse = now
+	}
+	one.loadAt = now
 
-		// update deleted tokens in map to DB
-		for i := 0; i < len(delTokens); i++ {
-			err := updateToken(delTokens[i], delLatest[i])
-			errChan <- err
+	shard := s.shard(tk)
+	shard.lock.Lock()
+	old, ok := shard.all[tk]
+	if ok {
+		one.slot = old.slot
+		one.referenced = old.referenced
+		one.uses += old.uses
+		if old.firstUse > 0 && (one.firstUse == 0 || old.firstUse < one.firstUse) {
+			one.firstUse = old.firstUse
+		}
+		if one.lastIP == "" {
+			one.lastIP = old.lastIP
 		}
+		if one.lastAgent == "" {
+			one.lastAgent = old.lastAgent
+		}
+	}
+	var evicted string
+	var evictedLatest tokenLatest
+	var full bool
+	if !ok && s.limit > 0 {
+		s.reloaded(tk, &one)
+		evicted, evictedLatest, full = shard.place(tk, &one, s.limit)
+	}
+	shard.all[tk] = &one
+	shard.lock.Unlock()
+
+	if full {
+		s.evictFull(evicted, evictedLatest)
 	}
 }
 
-func getAndSetMap(tk string) int32 {
-	allTokens.lock.Lock()
-	defer allTokens.lock.Unlock()
+// cleanToken to remove "-" and lower case, the same format as made.
+func cleanToken(tk string) string {
+	return strings.ToLower(strings.Replace(tk, "-", "", -1))
+}
 
-	userid := int32(0)
-	if info, ok := allTokens.all[tk]; ok {
-		userid = info.userid
-		info.lastUse = int32(time.Now().Unix())
+// isToken to check whether tk is in the format made, 32 lower case hex digits.
+// Anything else is never looked up in Redis or DB, it might name a key used for something else.
+func isToken(tk string) bool {
+	if len(tk) != 32 {
+		return false
 	}
-	return userid
+	for i := 0; i < len(tk); i++ {
+		if c := tk[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
 }
 
-func setToMap(tk string, userid int32) {
-	allTokens.lock.Lock()
-	allTokens.all[tk] = &tokenLatest{
-		userid:  userid,
-		lastUse: int32(time.Now().Unix()),
+// saveToken to set token to db, cache and map, opts can be nil.
+func saveToken(one *TokenInfo, opts *TokenOptions) (string, error) {
+	if !dbBreaker.allow() {
+		return "", ErrDegraded
+	}
+
+	// insert token to DB
+	if err := setToken(one); isDBDown(err) {
+		return "", ErrDegraded
+	} else if err != nil {
+		return "", err
+	}
+
+	latest := tokenLatest{
+		userid:   one.UserID,
+		expireAt: one.ExpireAt,
+		scopes:   one.Scopes,
+		binding:  one.binding,
+	}
+
+	// the token is made even the audit is not written
+	var reason string
+	var meta map[string]interface{}
+	if opts != nil {
+		reason, meta = opts.Reason, opts.Meta
+	}
+	auditErr := addAudit(dbPool, AuditCreate, []int32{one.UserID}, []string{one.Token}, []string{reason}, meta)
+
+	// add token to Redis
+	if err := skipOpen(setRedisCache([]string{one.Token}, []tokenLatest{latest})); err != nil {
+		return one.Token, ErrCache
+	}
+
+	// add token to Map, and tell other processes it exists now
+	setToMap(one.Token, latest)
+	bloomAdd(one.Token)
+	if mapNegativeSecond > 0 || mapBloomCapacity > 0 {
+		forgetMissing([]string{one.Token})
+		if err := publish(busCreate, one.Token); err != nil {
+			return one.Token, ErrCache
+		}
+	}
+
+	if auditErr != nil {
+		return one.Token, ErrAudit
 	}
-	allTokens.lock.Unlock()
+	return one.Token, nil
 }
 
 // MakeToken to make and set token to db, cache and map.
 // If error == kktoken.ErrCache, it means db is set, but cache not.
+// If error == kktoken.ErrAudit, it means the token is made, but the audit not written.
+// If error == kktoken.ErrDegraded, it means DB is not available and nothing is made.
 func MakeToken(userid int32, info map[string]interface{}) (string, error) {
+	return MakeTokenWithOptions(userid, info, nil)
+}
+
+// MakeTokenWithOptions to make a token like MakeToken with the optional settings, opts can be nil.
+func MakeTokenWithOptions(userid int32, info map[string]interface{}, opts *TokenOptions) (string, error) {
 	if userid <= 0 {
 		return "", errors.New("userid should no less than 0")
 	}
 	// Generate a UUID v4 token, remove "-" and lower case
-	tk := strings.ToLower(strings.Replace(uuid.NewV4().String(), "-", "", -1))
+	tk := cleanToken(uuid.NewV4().String())
 	now := time.Now().Unix()
 
 	one := TokenInfo{
@@ -165,77 +641,459 @@ func MakeToken(userid int32, info map[string]interface{}) (string, error) {
 		CreateAt: int32(now),
 		LastUse:  int32(now),
 	}
+	if opts != nil {
+		if opts.LiveSecond > 0 {
+			one.ExpireAt = int32(now + int64(opts.LiveSecond))
+		}
+		one.Scopes = opts.Scopes
 
-	// insert token to DB
-	if err := setToken(&one); err != nil {
+		var err error
+		if one.binding, err = newClientBinding(opts.Binding); err != nil {
+			return "", err
+		}
+	}
+	return saveToken(&one, opts)
+}
+
+// MakeChildToken to make a token derived from the parent token for the same user.
+// The child will be deleted when the parent is deleted, opts can be nil.
+// The child of a bound parent is bound to the same client, opts.Binding is only used when the parent is not bound.
+// If error == kktoken.ErrCache, it means db is set, but cache not.
+// If error == kktoken.ErrAudit, it means the token is made, but the audit not written.
+// If error == kktoken.ErrDegraded, it means DB is not available and nothing is made.
+func MakeChildToken(parent string, info map[string]interface{}, opts *TokenOptions) (string, error) {
+	if !dbBreaker.allow() {
+		return "", ErrDegraded
+	}
+
+	// always check the parent in DB, it might just be deleted
+	parentLatest, err := getUserID(parent)
+	if err != nil {
 		return "", err
+	} else if parentLatest.userid <= 0 {
+		return "", ErrNoParent
 	}
 
-	// add token to Redis
-	if err := setRedisCache([]string{tk}, []int32{userid}); err != nil {
-		return tk, ErrCache
+	// Generate a UUID v4 token, remove "-" and lower case
+	tk := cleanToken(uuid.NewV4().String())
+	now := time.Now().Unix()
+
+	one := TokenInfo{
+		Token:    tk,
+		Info:     info,
+		UserID:   parentLatest.userid,
+		CreateAt: int32(now),
+		LastUse:  int32(now),
+		Parent:   cleanToken(parent),
+		ExpireAt: parentLatest.expireAt,
+		Scopes:   parentLatest.scopes,
+		binding:  parentLatest.binding,
+	}
+	if opts != nil && opts.LiveSecond > 0 {
+		// the child can't live longer than the parent
+		expireAt := int32(now + int64(opts.LiveSecond))
+		if one.ExpireAt == 0 || expireAt < one.ExpireAt {
+			one.ExpireAt = expireAt
+		}
+	}
+	if opts != nil && opts.Scopes != nil {
+		// the child can't have more permissions than the parent
+		if !coverScopes(parentLatest.scopes, opts.Scopes) {
+			return "", ErrScopes
+		}
+		one.Scopes = opts.Scopes
+	}
+	if opts != nil && one.binding == nil {
+		if one.binding, err = newClientBinding(opts.Binding); err != nil {
+			return "", err
+		}
+	}
+	return saveToken(&one, opts)
+}
+
+// getLatest to get the token information through map, cache and DB.
+// The userid will be 0 if not found, the error will be ErrSuspended if the user is suspended.
+func getLatest(token string, client *Client) (tokenLatest, error) {
+	one, err := findLatest(token, client, true)
+	if one.userid > 0 && isSuspended(one.userid) {
+		return tokenLatest{}, ErrSuspended
+	}
+	return one, err
+}
+
+// findLatest to get the token information through map, cache and DB, the suspension is not checked.
+// A use by the client is recorded if used, otherwise the token is not loaded to map either.
+func findLatest(token string, client *Client, used bool) (tokenLatest, error) {
+	var one tokenLatest
+	var err error
+	if !isToken(token) {
+		return tokenLatest{}, nil
+	}
+
+	// get userid from Map
+	if used {
+		one = getAndSetMap(token, client)
+	} else {
+		one = getMap(token)
+	}
+	if one.userid > 0 {
+		return one, nil
+	} else if isMissing(token) {
+		return tokenLatest{}, nil
+	}
+	// a token made by other processes is cached in Redis before they tell,
+	// so the ones not in the filter are still looked up in Redis but not in DB
+	rejected := bloomReject(token)
+
+	// get user id from cache, or DB if failed
+	if one, err = getRedisCache(token); err != nil {
+		one = tokenLatest{}
+		rejected = false
+	} else if one.userid > 0 {
+		if used {
+			one.use(client)
+			setToMap(token, one)
+		}
+		return one, nil
+	} else if one.userid == missingUserID {
+		evictMap([]string{token})
+		setMissing(token)
+		return tokenLatest{}, nil
+	} else if rejected {
+		return tokenLatest{}, nil
+	}
+
+	// then, get from DB, only once for the callers at the same time
+	if !dbBreaker.allow() {
+		return tokenLatest{}, ErrDegraded
+	}
+	one, _, err = dbFlight.do(token, func() (tokenLatest, error) {
+		return loadLatest(token)
+	})
+	if one.userid == missingUserID {
+		// not found from DB, a stale one in map might be left
+		evictMap([]string{token})
+		setMissing(token)
+		return tokenLatest{}, err
+	} else if one.userid <= 0 {
+		return tokenLatest{}, err
 	}
 
 	// add token to Map
-	setToMap(tk, userid)
+	if used {
+		one.use(client)
+		setToMap(token, one)
+	}
+	return one, err
+}
 
-	return tk, nil
+// loadLatest to get the token information from DB and set it to cache.
+// The userid will be missingUserID if not found.
+func loadLatest(token string) (tokenLatest, error) {
+	one, err := getUserID(token)
+	if err != nil {
+		return tokenLatest{}, err
+	} else if one.userid <= 0 {
+		return tokenLatest{userid: missingUserID}, skipOpen(setRedisMissing(token))
+	}
+
+	// if in db, set to cache
+	return one, skipOpen(setRedisCache([]string{token}, []tokenLatest{one}))
 }
 
 // GetUserID to get userid from token.
 // return userid, got, error
 // the error can be kktoken.ErrCache.
+// A token with binding can only be got by GetClientUserID.
 func GetUserID(token string) (int32, error) {
-	var userid int32
-	var err error
+	return GetClientUserID(token, nil)
+}
 
-	// get userid from Map
-	if userid = getAndSetMap(token); userid > 0 {
-		return userid, nil
+// GetClientUserID to get userid from token used by the client.
+// The IP and user agent of the client will be flushed to DB with last_use and the use count.
+// If the client doesn't match the binding of the token, the error will be *kktoken.BindingError,
+// unless the binding is report only.
+// If the client failed RDSInfo.FailLimit lookups, the error will be kktoken.ErrLocked.
+// If the token is not in map or Redis while DB is not available, the error will be kktoken.ErrDegraded.
+func GetClientUserID(token string, client *Client) (int32, error) {
+	if err := checkLocked(client); err != nil {
+		return 0, err
 	}
+	token = cleanToken(token)
 
-	// get user id from cache
-	if userid, err = getRedisCache(token); err != nil {
-		return userid, err
-	} else if userid > 0 {
-		setToMap(token, userid)
-		return userid, nil
+	one, err := getLatest(token, client)
+	if one.userid <= 0 {
+		if err == nil {
+			// not found
+			err = addFailure(client)
+		}
+		return 0, err
+	}
+	if err := checkBinding(token, one, client); err != nil {
+		return 0, err
 	}
+	return one.userid, err
+}
 
-	// then, get from DB
-	if userid, err = getUserID(token); err != nil {
-		return userid, err
-	} else if userid <= 0 {
-		// not found from DB
-		return userid, nil
+// CheckToken to get the status of the token used by the client, like why it's not valid.
+// Revoked and expired tokens are only known when DBInfo.TombstoneSecond is set.
+// Checking a token is not a use of it, last_use and the use count are not changed.
+func CheckToken(token string, client *Client) (TokenStatus, error) {
+	token = cleanToken(token)
+	if !isToken(token) {
+		return TokenStatus{State: StateUnknown}, nil
+	}
+	one, err := findLatest(token, client, false)
+	if one.userid <= 0 {
+		if err != nil {
+			return TokenStatus{}, err
+		}
+		return explainToken(token)
 	}
 
-	// if in db, set to cache
-	if err := setRedisCache([]string{token}, []int32{userid}); err != nil {
-		return userid, err
+	if isSuspended(one.userid) {
+		return TokenStatus{State: StateSuspended, UserID: one.userid}, nil
 	}
+	if checkBinding(token, one, client) != nil {
+		return TokenStatus{State: StateMismatch, UserID: one.userid}, nil
+	}
+	return TokenStatus{State: StateValid, UserID: one.userid}, err
+}
 
-	// add token to Map
-	setToMap(token, userid)
+// HasScope to check whether the token is valid and granted the scope.
+// The granted scope "orders:*" covers "orders:read" and "orders:items:write".
+// The binding of the token is not checked, use HasClientScope with the client of the request for bound tokens.
+func HasScope(token, scope string) (bool, error) {
+	one, err := getLatest(cleanToken(token), nil)
+	if one.userid <= 0 {
+		return false, err
+	}
+	return hasScope(one.scopes, scope), err
+}
 
-	return userid, nil
+// HasClientScope to check whether the token used by the client is valid and granted the scope.
+// The client is checked against the binding of the token like GetClientUserID, err can be *BindingError.
+func HasClientScope(token, scope string, client *Client) (bool, error) {
+	token = cleanToken(token)
+	one, err := getLatest(token, client)
+	if one.userid <= 0 {
+		return false, err
+	}
+	if err := checkBinding(token, one, client); err != nil {
+		return false, err
+	}
+	return hasScope(one.scopes, scope), err
 }
 
-// DelToken to delete the token.
+// DelToken to delete the token, all the tokens derived from it will also be deleted.
 func DelToken(token string) error {
-	allTokens.lock.Lock()
-	delete(allTokens.all, token)
-	allTokens.lock.Unlock()
+	return RevokeToken(token, "", nil)
+}
+
+// RevokeToken to delete the token like DelToken, with the reason written to the tombstone and audit tables,
+// and the meta written to the audit table.
+// If error == kktoken.ErrAudit, it means the token is deleted, but the audit not written.
+func RevokeToken(token, reason string, meta map[string]interface{}) error {
+	// delete from DB first to know all the descendants
+	tokens, userids, err2 := delToken(token, reason)
+	if err2 == nil {
+		err2 = addTombstones(dbPool, tokens, userids, []string{string(StateRevoked)}, []string{reason})
+	}
+	if err2 == nil {
+		if err := addAudit(dbPool, AuditRevoke, userids, tokens, []string{reason}, meta); err != nil {
+			err2 = ErrAudit
+		}
+	}
+	tokens = append(tokens, token)
 
-	err1 := delRedisCache(token)
-	err2 := delToken(token)
+	err1 := evictTokens(tokens)
 	if err1 != nil {
 		return err1
 	}
 	return err2
 }
 
+// DelTokensByInfo to delete all the tokens matching all the info filters, and the tokens derived from them.
+// Return how many tokens deleted.
+// If error == kktoken.ErrAudit, it means the tokens are deleted, but the audit not written.
+func DelTokensByInfo(filters []InfoFilter) (int, error) {
+	tokens, userids, err := delTokensByInfo(filters)
+	if err == nil {
+		err = addTombstones(dbPool, tokens, userids, []string{string(StateRevoked)}, []string{"info"})
+	}
+	if err != nil {
+		return 0, err
+	}
+	auditErr := addAudit(dbPool, AuditRevoke, userids, tokens, []string{"info"}, nil)
+
+	if err := evictTokens(tokens); err != nil {
+		return len(tokens), err
+	}
+	if auditErr != nil {
+		return len(tokens), ErrAudit
+	}
+	return len(tokens), nil
+}
+
+// RevokeUserTokens to delete all the tokens of a user, with the reason written to the tombstone and audit tables.
+// Return how many tokens deleted.
+// If error == kktoken.ErrAudit, it means the tokens are deleted, but the audit not written.
+func RevokeUserTokens(userid int32, reason string) (int, error) {
+	tokens, userids, err := delUserTokens(userid, reason)
+	if err == nil {
+		err = addTombstones(dbPool, tokens, userids, []string{string(StateRevoked)}, []string{reason})
+	}
+	if err != nil {
+		return 0, err
+	}
+	auditErr := addAudit(dbPool, AuditRevoke, userids, tokens, []string{reason}, nil)
+
+	if err := evictTokens(tokens); err != nil {
+		return len(tokens), err
+	}
+	if auditErr != nil {
+		return len(tokens), ErrAudit
+	}
+	return len(tokens), nil
+}
+
+// UpdateTokenInfo to replace the attached information of the token.
+// Other processes will load the token again with RDSInfo.Channel or DBInfo.NotifyChannel set.
+// If error == kktoken.ErrNoToken, it means the token is not found in DB.
+func UpdateTokenInfo(token string, info map[string]interface{}) error {
+	token = cleanToken(token)
+	if ok, err := updateInfo(token, info); err != nil {
+		return err
+	} else if !ok {
+		return ErrNoToken
+	}
+
+	evictMap([]string{token})
+	return publish(busUpdate, token)
+}
+
+// FindTokens to get the tokens matching all the info filters only from database.
+// For example, {Key: "app_version", Op: "<", Value: 3.2}, limit 0 means no limit.
+func FindTokens(filters []InfoFilter, limit int) ([]TokenInfo, error) {
+	return findTokens(filters, limit)
+}
+
+// evictTokens to delete tokens from map and cache, and tell other processes to delete them from their maps.
+// The pending retries of them are dropped, not to write them back.
+func evictTokens(tokens []string) error {
+	evictMap(tokens)
+	rdsRetry.drop(tokens)
+	dbRetry.drop(tokens)
+
+	if err := delRedisCache(tokens...); err == errRedisOpen {
+		// delete them when Redis is back
+		rdsPending.add(tokens...)
+	} else if err != nil {
+		return err
+	}
+	return publish(busRevoke, tokens...)
+}
+
+// evictMap to delete tokens from map.
+func evictMap(tokens []string) {
+	allTokens.evict(tokens)
+}
+
+// evict to delete tokens from the store.
+func (s *tokenStore) evict(tokens []string) {
+	for _, tk := range tokens {
+		shard := s.shard(tk)
+		shard.lock.Lock()
+		delete(shard.all, tk)
+		shard.lock.Unlock()
+	}
+}
+
+// SuspendUser to reject all the tokens of a user with ErrSuspended without deleting them.
+// Other processes sharing the same Redis will reject them at once with RDSInfo.Channel or DBInfo.NotifyChannel set,
+// otherwise after their next map EXPCheck.
+func SuspendUser(userid int32) error {
+	return SuspendUserWithReason(userid, "", nil)
+}
+
+// SuspendUserWithReason to suspend the user like SuspendUser, with the reason and the meta like who suspended it
+// written to the audit table.
+// If error == kktoken.ErrAudit, it means the user is suspended, but the audit not written.
+func SuspendUserWithReason(userid int32, reason string, meta map[string]interface{}) error {
+	if err := setSuspend(userid); err != nil {
+		return err
+	}
+
+	allSuspended.lock.Lock()
+	allSuspended.all[userid] = true
+	allSuspended.lock.Unlock()
+
+	emit(Event{
+		Kind:   EventSuspend,
+		UserID: userid,
+	})
+	if err := skipOpen(addRedisSuspend(userid)); err != nil {
+		return err
+	}
+	if err := publishUser(busSuspend, userid); err != nil {
+		return err
+	}
+	if err := addAudit(dbPool, AuditSuspend, []int32{userid}, []string{""}, []string{reason}, meta); err != nil {
+		return ErrAudit
+	}
+	return nil
+}
+
+// ResumeUser to accept the tokens of a suspended user again.
+// Other processes sharing the same Redis will accept them at once with RDSInfo.Channel or DBInfo.NotifyChannel set,
+// otherwise after their next map EXPCheck.
+// If it fails, the user is still suspended.
+func ResumeUser(userid int32) error {
+	return ResumeUserWithReason(userid, "", nil)
+}
+
+// ResumeUserWithReason to resume the user like ResumeUser, with the reason and the meta like who resumed it
+// written to the audit table.
+// If error == kktoken.ErrAudit, it means the user is resumed, but the audit not written.
+func ResumeUserWithReason(userid int32, reason string, meta map[string]interface{}) error {
+	if err := delSuspend(userid); err != nil {
+		return err
+	}
+	if err := skipOpen(remRedisSuspend(userid)); err != nil {
+		// Redis still has the user, keep it suspended in DB as well
+		if e := setSuspend(userid); e != nil {
+			sendError(fmt.Errorf("user %d resumed in DB but still suspended in Redis: %v", userid, e))
+		}
+		return err
+	}
+
+	allSuspended.lock.Lock()
+	delete(allSuspended.all, userid)
+	allSuspended.lock.Unlock()
+
+	emit(Event{
+		Kind:   EventResume,
+		UserID: userid,
+	})
+	if err := publishUser(busResume, userid); err != nil {
+		return err
+	}
+	if err := addAudit(dbPool, AuditResume, []int32{userid}, []string{""}, []string{reason}, meta); err != nil {
+		return ErrAudit
+	}
+	return nil
+}
+
 // GetUserTokens to get all tokens of a user only from database
 func GetUserTokens(userid int32) ([]TokenInfo, error) {
 	return getAllTokens(userid)
 }
+
+// GetUserTokensPage to get a page of tokens of a user only from database, q can be nil.
+// Use the NextCursor of the page as the Cursor of the query to get the next page.
+func GetUserTokensPage(userid int32, q *PageQuery) (*TokenPage, error) {
+	if q == nil {
+		q = &PageQuery{}
+	}
+	return getTokensPage(userid, q)
+}
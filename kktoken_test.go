@@ -2,6 +2,7 @@ package kktoken
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
 	"testing"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/garyburd/redigo/redis"
 	"github.com/jackc/pgx"
+	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,22 +26,59 @@ func TestMain(t *testing.T) {
 
 	testTableGeneration(testTableName, t)
 
+	testScopes(t)
 	testGetAndSetMap(t)
+	testMapShards(t)
+	testMapLimit(t)
+	testEvictedReload(t)
 	testPublicMethods(t)
 	testGetFromCache(t)
 	testGetFromDB(t)
+	testChildTokens(t)
+	testTokenScopes(t)
+	testBindingMismatch(t)
+	testBindingTokens(t)
+	testSuspendUser(t)
+	testFindTokens(t)
+	testRevokeUserTokens(t)
+	testUpdateTokenInfo(t)
+	testLastClient(t)
+	testUseStats(t)
+	testAudit(t)
+	testTombstone(t)
+	testHistory(t)
+	testNegativeCache(t)
+	testFlightGroup(t)
+	testBusMessages(t)
+	testRedisBus(t)
+	testPostgresBus(t)
+	testBloomFilter(t)
+	testBloomReject(t)
+	testFailLimit(t)
+	testCircuitBreaker(t)
+	testRedisBreaker(t)
+	testDegraded(t)
+	testRetryBackoff(t)
+	testRetryWrites(t)
+	testRetryRevoked(t)
 	testMapEXPCheck(t)
 
 	testCacheMethods(t)
+	testLegacyValue(t)
 	testDBMethods(t)
 
+	// stop the goroutines using the tables
+	Stop()
+
 	if dbPool != nil {
-		_, err := dbPool.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s;", testTableName))
-		assert.NoError(t, err, "Should not have error when drop table.")
+		for _, table := range []string{testTableName, testTableName + "_suspend", testTableName + "_audit", testTableName + "_tombstone", testTableName + "_history"} {
+			_, err := dbPool.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s;", table))
+			assert.NoError(t, err, "Should not have error when drop table.")
+		}
 	}
 }
 
-func getDBInfo(t *testing.T) *DBInfo {
+func getDBInfo(t testing.TB) *DBInfo {
 	DBName := os.Getenv("dbname")
 	DBHost := os.Getenv("dbhost")
 	DBUser := os.Getenv("dbuser")
@@ -67,7 +106,7 @@ func getDBInfo(t *testing.T) *DBInfo {
 	}
 }
 
-func getRDSInfo(t *testing.T) *RDSInfo {
+func getRDSInfo(t testing.TB) *RDSInfo {
 	RDSHost := os.Getenv("rdshost")
 
 	opt1 := redis.DialConnectTimeout(5 * time.Second)
@@ -105,29 +144,95 @@ func testInvalidUseParameters(t *testing.T) {
 	assert.Nil(t, errChan, "err channel should be nil")
 }
 
+// peekMap to get the token in map without using it.
+func peekMap(tk string) (tokenLatest, bool) {
+	return allTokens.peek(tk)
+}
+
+// peek to get the token in the store without using it.
+func (s *tokenStore) peek(tk string) (tokenLatest, bool) {
+	shard := s.shard(tk)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	one, ok := shard.all[tk]
+	if !ok {
+		return tokenLatest{}, false
+	}
+	return *one, true
+}
+
+func testMapShards(t *testing.T) {
+	// not to leave the tokens in the map of the process
+	store := newTokenStore(mapShards)
+	var tokens []string
+	for i := 0; i < 1000; i++ {
+		tk := cleanToken(uuid.NewV4().String())
+		store.set(tk, tokenLatest{userid: 1})
+		tokens = append(tokens, tk)
+	}
+
+	used := 0
+	for i := range store.shards {
+		if len(store.shards[i].all) > 0 {
+			used++
+		}
+	}
+	assert.Equal(t, mapShards, used, "tokens should be spread over all the shards")
+	assert.Equal(t, store.shard(tokens[0]), store.shard(tokens[0]), "the same token should be in the same shard")
+	assert.Equal(t, int32(1), store.getAndSet(tokens[0], nil).userid, "should get from its shard")
+
+	store.evict(tokens)
+	for _, tk := range tokens {
+		_, ok := store.peek(tk)
+		assert.False(t, ok, "should be evicted")
+	}
+}
+
+// BenchmarkGetAndSetMap to compare the lookups in parallel with one lock and with shards.
+// Run it with -cpu 1,8 to see the contention, the shards make no difference on one CPU.
+func BenchmarkGetAndSetMap(b *testing.B) {
+	for _, n := range []int{1, mapShards} {
+		b.Run(fmt.Sprintf("shards-%d", n), func(b *testing.B) {
+			store := newTokenStore(n)
+			tokens := make([]string, 1024)
+			for i := range tokens {
+				tokens[i] = cleanToken(uuid.NewV4().String())
+				store.set(tokens[i], tokenLatest{userid: 1})
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Intn(len(tokens))
+				for pb.Next() {
+					store.getAndSet(tokens[i%len(tokens)], nil)
+					i++
+				}
+			})
+		})
+	}
+}
+
 func testGetAndSetMap(t *testing.T) {
 	tk := "abc"
 	userid := int32(2)
 	now := int32(time.Now().Unix())
-	setToMap(tk, userid)
+	setToMap(tk, tokenLatest{userid: userid})
 
 	time.Sleep(1 * time.Second)
 
 	// get userid from Map
-	gotUserID := getAndSetMap(tk)
-	assert.Equal(t, userid, gotUserID, "got user id wrong")
+	got := getAndSetMap(tk, nil)
+	assert.Equal(t, userid, got.userid, "got user id wrong")
 
 	// get a non-existed userid
-	gotUserID = getAndSetMap("aaa")
-	assert.Equal(t, int32(0), gotUserID, "got user id wrong")
+	got = getAndSetMap("aaa", nil)
+	assert.Equal(t, int32(0), got.userid, "got user id wrong")
 
 	// check last_use
-	allTokens.lock.Lock()
-	info, ok := allTokens.all[tk]
+	info, ok := peekMap(tk)
 	assert.True(t, ok, "should be true to find in Map")
 	assert.Equal(t, now+1, info.lastUse, "last_use wrong")
-	delete(allTokens.all, "tk")
-	allTokens.lock.Unlock()
+	evictMap([]string{tk})
 }
 
 func testPublicMethods(t *testing.T) {
@@ -139,21 +244,21 @@ func testPublicMethods(t *testing.T) {
 	assert.NoError(t, err, "should not have error to make token")
 
 	// should be able to find in Map
-	gotUserID := getAndSetMap(tk)
-	assert.Equal(t, userid, gotUserID, "should be able to find in Map")
+	got := getAndSetMap(tk, nil)
+	assert.Equal(t, userid, got.userid, "should be able to find in Map")
 
 	// should be able to find in Cache
-	gotUserID, err = getRedisCache(tk)
+	got, err = getRedisCache(tk)
 	assert.NoError(t, err, "should not have error to get from cache")
-	assert.Equal(t, userid, gotUserID, "should be able to find in Cache")
+	assert.Equal(t, userid, got.userid, "should be able to find in Cache")
 
 	// should be able to find in DB
-	gotUserID, err = getUserID(tk)
+	got, err = getUserID(tk)
 	assert.NoError(t, err, "should not have error to get from DB")
-	assert.Equal(t, userid, gotUserID, "should be able to find in DB")
+	assert.Equal(t, userid, got.userid, "should be able to find in DB")
 
 	// Public get method
-	gotUserID, err = GetUserID(tk)
+	gotUserID, err := GetUserID(tk)
 	assert.NoError(t, err, "should not have error to get with public method")
 	assert.Equal(t, userid, gotUserID, "should be able to find with public method")
 
@@ -168,18 +273,18 @@ func testPublicMethods(t *testing.T) {
 	assert.NoError(t, err, "should not have error to delete with public method")
 
 	// should be able to find in Map
-	gotUserID = getAndSetMap(tk)
-	assert.Equal(t, int32(0), gotUserID, "should not be able to find in Map")
+	got = getAndSetMap(tk, nil)
+	assert.Equal(t, int32(0), got.userid, "should not be able to find in Map")
 
 	// should be able to find in Cache
-	gotUserID, err = getRedisCache(tk)
+	got, err = getRedisCache(tk)
 	assert.NoError(t, err, "should not have error to get from cache")
-	assert.Equal(t, int32(0), gotUserID, "should not be able to find in Cache")
+	assert.Equal(t, int32(0), got.userid, "should not be able to find in Cache")
 
 	// should be able to find in DB
-	gotUserID, err = getUserID(tk)
+	got, err = getUserID(tk)
 	assert.NoError(t, err, "should not have error to get from DB")
-	assert.Equal(t, int32(0), gotUserID, "should not be able to find in DB")
+	assert.Equal(t, int32(0), got.userid, "should not be able to find in DB")
 }
 
 func testGetFromCache(t *testing.T) {
@@ -191,12 +296,10 @@ func testGetFromCache(t *testing.T) {
 	assert.NoError(t, err, "should not have error to make token")
 
 	// delete from Map
-	allTokens.lock.Lock()
-	delete(allTokens.all, tk)
-	allTokens.lock.Unlock()
+	evictMap([]string{tk})
 
 	// delete from DB
-	err = delToken(tk)
+	_, _, err = delToken(tk, "")
 	assert.NoError(t, err, "should not have error to delete from DB")
 
 	// get
@@ -205,8 +308,8 @@ func testGetFromCache(t *testing.T) {
 	assert.Equal(t, userid, gotUserID, "should be able to find with public method")
 
 	// Map should be set
-	gotUserID = getAndSetMap(tk)
-	assert.Equal(t, userid, gotUserID, "should be able to find with Map")
+	got := getAndSetMap(tk, nil)
+	assert.Equal(t, userid, got.userid, "should be able to find with Map")
 
 	// delete
 	err = DelToken(tk)
@@ -222,9 +325,7 @@ func testGetFromDB(t *testing.T) {
 	assert.NoError(t, err, "should not have error to make token")
 
 	// delete from Map
-	allTokens.lock.Lock()
-	delete(allTokens.all, tk)
-	allTokens.lock.Unlock()
+	evictMap([]string{tk})
 
 	// delete from Redis
 	err = delRedisCache(tk)
@@ -236,19 +337,370 @@ func testGetFromDB(t *testing.T) {
 	assert.Equal(t, userid, gotUserID, "should be able to find with public method")
 
 	// Map should be set
-	gotUserID = getAndSetMap(tk)
-	assert.Equal(t, userid, gotUserID, "should be able to find with Map")
+	got := getAndSetMap(tk, nil)
+	assert.Equal(t, userid, got.userid, "should be able to find with Map")
 
 	// Redis should be set
-	gotUserID, err = getRedisCache(tk)
+	got, err = getRedisCache(tk)
 	assert.NoError(t, err, "should not have error to get from Redis")
-	assert.Equal(t, userid, gotUserID, "should be able to find in Redis")
+	assert.Equal(t, userid, got.userid, "should be able to find in Redis")
 
 	// delete
 	err = DelToken(tk)
 	assert.NoError(t, err, "should not have error to delete with public method")
 }
 
+func testChildTokens(t *testing.T) {
+	userid := int32(9)
+	info := map[string]interface{}{
+		"device": "ios",
+	}
+	tk, err := MakeToken(userid, info)
+	assert.NoError(t, err, "should not have error to make token")
+
+	// parent must exist
+	_, err = MakeChildToken(uuid.NewV4().String(), nil, nil)
+	assert.Equal(t, ErrNoParent, err, "should not make child without parent")
+
+	child, err := MakeChildToken(tk, map[string]interface{}{"device": "webview"}, &TokenOptions{LiveSecond: 2})
+	assert.NoError(t, err, "should not have error to make child token")
+	grandChild, err := MakeChildToken(child, nil, &TokenOptions{LiveSecond: 100})
+	assert.NoError(t, err, "should not have error to make grandchild token")
+
+	// the child belongs to the same user
+	gotUserID, err := GetUserID(grandChild)
+	assert.NoError(t, err, "should not have error to get child token")
+	assert.Equal(t, userid, gotUserID, "child userid wrong")
+
+	// grandchild can't outlive the child
+	got, err := getUserID(grandChild)
+	assert.NoError(t, err, "should not have error to get from DB")
+	got2, err := getUserID(child)
+	assert.NoError(t, err, "should not have error to get from DB")
+	assert.Equal(t, got2.expireAt, got.expireAt, "grandchild should expire with child")
+
+	tokens, err := GetUserTokens(userid)
+	assert.NoError(t, err, "should not have error to get all tokens")
+	assert.Len(t, tokens, 3, "should find 3 tokens")
+
+	// delete the root should delete all in every tier
+	err = DelToken(tk)
+	assert.NoError(t, err, "should not have error to delete with public method")
+	for _, one := range []string{tk, child, grandChild} {
+		got = getAndSetMap(one, nil)
+		assert.Equal(t, int32(0), got.userid, "should not be able to find in Map")
+
+		got, err = getRedisCache(one)
+		assert.NoError(t, err, "should not have error to get from cache")
+		assert.Equal(t, int32(0), got.userid, "should not be able to find in Cache")
+
+		got, err = getUserID(one)
+		assert.NoError(t, err, "should not have error to get from DB")
+		assert.Equal(t, int32(0), got.userid, "should not be able to find in DB")
+	}
+
+	// the absolute expiration
+	tk, err = MakeToken(userid, info)
+	assert.NoError(t, err, "should not have error to make token")
+	child, err = MakeChildToken(tk, nil, &TokenOptions{LiveSecond: 1})
+	assert.NoError(t, err, "should not have error to make child token")
+
+	time.Sleep(1100 * time.Millisecond)
+	gotUserID, err = GetUserID(child)
+	assert.NoError(t, err, "should not have error to get expired child")
+	assert.Equal(t, int32(0), gotUserID, "child should be expired")
+
+	err = DelToken(tk)
+	assert.NoError(t, err, "should not have error to delete with public method")
+}
+
+func testTokenScopes(t *testing.T) {
+	userid := int32(12)
+	tk, err := MakeTokenWithOptions(userid, nil, &TokenOptions{Scopes: []string{"orders:*", "profile:read"}})
+	assert.NoError(t, err, "should not have error to make token")
+
+	// check from Map
+	ok, err := HasScope(tk, "orders:read")
+	assert.NoError(t, err, "should not have error to check scope")
+	assert.True(t, ok, "should have the scope")
+	ok, err = HasScope(tk, "profile:write")
+	assert.NoError(t, err, "should not have error to check scope")
+	assert.False(t, ok, "should not have the scope")
+
+	// check from Redis
+	evictMap([]string{tk})
+	ok, err = HasScope(tk, "orders:items:write")
+	assert.NoError(t, err, "should not have error to check scope")
+	assert.True(t, ok, "should have the scope from cache")
+
+	// check from DB
+	evictMap([]string{tk})
+	err = delRedisCache(tk)
+	assert.NoError(t, err, "should not have error to delete from Redis")
+	ok, err = HasScope(tk, "profile:read")
+	assert.NoError(t, err, "should not have error to check scope")
+	assert.True(t, ok, "should have the scope from DB")
+
+	tokens, err := GetUserTokens(userid)
+	assert.NoError(t, err, "should not have error to get all tokens")
+	assert.Len(t, tokens, 1, "should find 1 token")
+	assert.Equal(t, []string{"orders:*", "profile:read"}, tokens[0].Scopes, "scopes wrong")
+
+	// a child can only have narrower scopes
+	_, err = MakeChildToken(tk, nil, &TokenOptions{Scopes: []string{"admin"}})
+	assert.Equal(t, ErrScopes, err, "should not make child with wider scopes")
+	child, err := MakeChildToken(tk, nil, &TokenOptions{Scopes: []string{"orders:read"}})
+	assert.NoError(t, err, "should not have error to make child token")
+	ok, err = HasScope(child, "orders:read")
+	assert.NoError(t, err, "should not have error to check scope")
+	assert.True(t, ok, "child should have the scope")
+	ok, err = HasScope(child, "profile:read")
+	assert.NoError(t, err, "should not have error to check scope")
+	assert.False(t, ok, "child should not have the scope")
+
+	// invalid token has no scope
+	ok, err = HasScope(uuid.NewV4().String(), "orders:read")
+	assert.NoError(t, err, "should not have error to check scope")
+	assert.False(t, ok, "invalid token should not have the scope")
+
+	err = DelToken(tk)
+	assert.NoError(t, err, "should not have error to delete with public method")
+}
+
+func testSuspendUser(t *testing.T) {
+	userid := int32(14)
+	tk, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+
+	err = SuspendUser(userid)
+	assert.NoError(t, err, "should not have error to suspend user")
+
+	// rejected from Map
+	gotUserID, err := GetUserID(tk)
+	assert.Equal(t, ErrSuspended, err, "should be suspended")
+	assert.Equal(t, int32(0), gotUserID, "userid should be 0 when suspended")
+
+	// rejected from DB, while the token is still there
+	evictMap([]string{tk})
+	err = delRedisCache(tk)
+	assert.NoError(t, err, "should not have error to delete from Redis")
+	_, err = GetUserID(tk)
+	assert.Equal(t, ErrSuspended, err, "should be suspended")
+	got, err := getUserID(tk)
+	assert.NoError(t, err, "should not have error to get from DB")
+	assert.Equal(t, userid, got.userid, "token should still be in DB")
+
+	// suspended by other process
+	allSuspended.lock.Lock()
+	delete(allSuspended.all, userid)
+	allSuspended.lock.Unlock()
+	err = syncSuspended()
+	assert.NoError(t, err, "should not have error to sync suspended users")
+	assert.True(t, isSuspended(userid), "should be synced from Redis")
+
+	// Redis lost the set
+	conn := rdsPool.Get()
+	_, err = conn.Do("DEL", rdsSuspendKey)
+	conn.Close()
+	assert.NoError(t, err, "should not have error to delete the set")
+	allSuspended.lock.Lock()
+	delete(allSuspended.all, userid)
+	allSuspended.lock.Unlock()
+	err = syncSuspended()
+	assert.NoError(t, err, "should not have error to sync suspended users")
+	assert.True(t, isSuspended(userid), "should be rebuilt from DB")
+	userids, _, err := getRedisSuspend()
+	assert.NoError(t, err, "should not have error to get suspended users from Redis")
+	assert.Contains(t, userids, userid, "should be set to Redis again")
+
+	userids, err = getAllSuspended()
+	assert.NoError(t, err, "should not have error to get suspended users")
+	assert.Contains(t, userids, userid, "should be suspended in DB")
+
+	// resume
+	err = ResumeUser(userid)
+	assert.NoError(t, err, "should not have error to resume user")
+	gotUserID, err = GetUserID(tk)
+	assert.NoError(t, err, "should not have error after resumed")
+	assert.Equal(t, userid, gotUserID, "userid wrong")
+
+	err = syncSuspended()
+	assert.NoError(t, err, "should not have error to sync suspended users")
+	assert.False(t, isSuspended(userid), "should be resumed in Redis")
+
+	err = DelToken(tk)
+	assert.NoError(t, err, "should not have error to delete with public method")
+}
+
+func testFindTokens(t *testing.T) {
+	userid := int32(15)
+	oldApp, err := MakeToken(userid, map[string]interface{}{"device": "android", "app_version": 3.1})
+	assert.NoError(t, err, "should not have error to make token")
+	child, err := MakeChildToken(oldApp, map[string]interface{}{"device": "webview"}, nil)
+	assert.NoError(t, err, "should not have error to make child token")
+	newApp, err := MakeToken(userid, map[string]interface{}{"device": "android", "app_version": 3.2})
+	assert.NoError(t, err, "should not have error to make token")
+	strApp, err := MakeToken(userid, map[string]interface{}{"device": "android", "app_version": "3.1"})
+	assert.NoError(t, err, "should not have error to make token")
+	ios, err := MakeToken(userid, map[string]interface{}{"device": "ios", "app_version": 3.1})
+	assert.NoError(t, err, "should not have error to make token")
+
+	filters := []InfoFilter{
+		{Key: "device", Op: "=", Value: "android"},
+		{Key: "app_version", Op: "<", Value: 3.2},
+	}
+	tokens, err := FindTokens(filters, 0)
+	assert.NoError(t, err, "should not have error to find tokens")
+	assert.Len(t, tokens, 1, "should find 1 token")
+	assert.Equal(t, oldApp, tokens[0].Token, "found token wrong")
+	assert.Equal(t, userid, tokens[0].UserID, "found userid wrong")
+
+	tokens, err = FindTokens([]InfoFilter{{Key: "device", Op: "!=", Value: "ios"}}, 0)
+	assert.NoError(t, err, "should not have error to find tokens")
+	assert.Len(t, tokens, 4, "should find 4 tokens")
+
+	tokens, err = FindTokens([]InfoFilter{{Key: "device", Op: "=", Value: "android"}}, 2)
+	assert.NoError(t, err, "should not have error to find tokens")
+	assert.Len(t, tokens, 2, "should find 2 tokens with limit")
+
+	// delete also the child
+	count, err := DelTokensByInfo(filters)
+	assert.NoError(t, err, "should not have error to delete tokens")
+	assert.Equal(t, 2, count, "should delete 2 tokens")
+	gotUserID, err := GetUserID(child)
+	assert.NoError(t, err, "should not have error to get deleted token")
+	assert.Equal(t, int32(0), gotUserID, "child should be deleted")
+
+	_, err = DelTokensByInfo(nil)
+	assert.Error(t, err, "should not delete without filters")
+
+	for _, tk := range []string{newApp, strApp, ios} {
+		err = DelToken(tk)
+		assert.NoError(t, err, "should not have error to delete with public method")
+	}
+}
+
+func testRevokeUserTokens(t *testing.T) {
+	userid := int32(20)
+	tk1, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+	_, err = MakeChildToken(tk1, nil, nil)
+	assert.NoError(t, err, "should not have error to make child token")
+	_, err = MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+	other, err := MakeToken(userid+1, nil)
+	assert.NoError(t, err, "should not have error to make token")
+
+	count, err := RevokeUserTokens(userid, "password_changed")
+	assert.NoError(t, err, "should not have error to revoke user tokens")
+	assert.Equal(t, 3, count, "should delete 3 tokens")
+
+	gotUserID, err := GetUserID(tk1)
+	assert.NoError(t, err, "should not have error to get deleted token")
+	assert.Equal(t, int32(0), gotUserID, "token should be deleted")
+	gotUserID, err = GetUserID(other)
+	assert.NoError(t, err, "should not have error to get token")
+	assert.Equal(t, userid+1, gotUserID, "token of other user should not be deleted")
+	assert.NoError(t, DelToken(other), "should not have error to delete token")
+}
+
+func testUpdateTokenInfo(t *testing.T) {
+	userid := int32(22)
+	tk, err := MakeToken(userid, map[string]interface{}{"device": "ios"})
+	assert.NoError(t, err, "should not have error to make token")
+
+	err = UpdateTokenInfo(tk, map[string]interface{}{"device": "android"})
+	assert.NoError(t, err, "should not have error to update info")
+	tokens, err := FindTokens([]InfoFilter{{Key: "device", Op: "=", Value: "android"}}, 0)
+	assert.NoError(t, err, "should not have error to find tokens")
+	assert.Len(t, tokens, 1, "should find the updated token")
+
+	err = UpdateTokenInfo("abc", nil)
+	assert.Equal(t, ErrNoToken, err, "should not update an invalid token")
+	err = UpdateTokenInfo(cleanToken(uuid.NewV4().String()), nil)
+	assert.Equal(t, ErrNoToken, err, "should not update a non-existed token")
+	assert.NoError(t, DelToken(tk), "should not have error to delete token")
+}
+
+func testLastClient(t *testing.T) {
+	userid := int32(16)
+	tk, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+
+	client := &Client{IP: net.ParseIP("10.1.2.3"), UserAgent: "Mozilla/5.0"}
+	_, err = GetClientUserID(tk, client)
+	assert.NoError(t, err, "should not have error to get userid")
+
+	// aggregated in Map
+	one, _ := peekMap(tk)
+	assert.Equal(t, "10.1.2.3", one.lastIP, "last ip wrong")
+	assert.Equal(t, "Mozilla/5.0", one.lastAgent, "last user agent wrong")
+
+	// a use without client keeps the last client
+	_, err = GetUserID(tk)
+	assert.NoError(t, err, "should not have error to get userid")
+	one, _ = peekMap(tk)
+	assert.Equal(t, "10.1.2.3", one.lastIP, "last ip wrong")
+
+	// flushed to DB
+	err = updateToken(tk, one)
+	assert.NoError(t, err, "should not have error to update token")
+	err = updateToken(tk, tokenLatest{lastUse: one.lastUse})
+	assert.NoError(t, err, "should not have error to update token")
+	tokens, err := GetUserTokens(userid)
+	assert.NoError(t, err, "should not have error to get all tokens")
+	if assert.Len(t, tokens, 1, "should find 1 token") {
+		assert.Equal(t, "10.1.2.3", tokens[0].LastIP, "last ip wrong in DB")
+		assert.Equal(t, "Mozilla/5.0", tokens[0].LastUserAgent, "last user agent wrong in DB")
+	}
+
+	err = DelToken(tk)
+	assert.NoError(t, err, "should not have error to delete with public method")
+}
+
+func testUseStats(t *testing.T) {
+	userid := int32(17)
+	tk, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+
+	// making is not a use
+	one, _ := peekMap(tk)
+	assert.Equal(t, int64(0), one.uses, "uses wrong")
+	assert.Equal(t, int32(0), one.firstUse, "first use wrong")
+
+	for i := 0; i < 3; i++ {
+		_, err = GetUserID(tk)
+		assert.NoError(t, err, "should not have error to get userid")
+	}
+	one, _ = peekMap(tk)
+	assert.Equal(t, int64(3), one.uses, "uses wrong")
+	assert.NotEqual(t, int32(0), one.firstUse, "first use wrong")
+
+	// flush twice, first use should not change
+	err = updateToken(tk, one)
+	assert.NoError(t, err, "should not have error to update token")
+	err = updateToken(tk, tokenLatest{lastUse: one.lastUse, uses: 2, firstUse: one.firstUse + 10})
+	assert.NoError(t, err, "should not have error to update token")
+
+	tokens, err := GetUserTokens(userid)
+	assert.NoError(t, err, "should not have error to get all tokens")
+	if assert.Len(t, tokens, 1, "should find 1 token") {
+		assert.Equal(t, int64(5), tokens[0].UseCount, "use count wrong")
+		assert.Equal(t, one.firstUse, tokens[0].FirstUse, "first use wrong")
+		assert.Equal(t, one.lastUse, tokens[0].LastUse, "last use wrong")
+	}
+
+	// got from Redis is a use
+	evictMap([]string{tk})
+	_, err = GetUserID(tk)
+	assert.NoError(t, err, "should not have error to get userid")
+	one, _ = peekMap(tk)
+	assert.Equal(t, int64(1), one.uses, "uses wrong")
+
+	err = DelToken(tk)
+	assert.NoError(t, err, "should not have error to delete with public method")
+}
+
 func testMapEXPCheck(t *testing.T) {
 	// generate a token
 	mapLiveSecond = 1
@@ -261,7 +713,9 @@ func testMapEXPCheck(t *testing.T) {
 	assert.NoError(t, err, "should not have error to make token")
 
 	// start exp check
-	go startMapEXPCheck(2)
+	goWorker(func() {
+		startMapEXPCheck(2)
+	})
 	time.Sleep(1520 * time.Millisecond)
 
 	tk2, err := MakeToken(int32(11), info)
@@ -270,18 +724,16 @@ func testMapEXPCheck(t *testing.T) {
 	time.Sleep(500 * time.Millisecond)
 
 	// check remains in Map
-	allTokens.lock.RLock()
-	_, ok := allTokens.all[tk]
+	_, ok := peekMap(tk)
 	assert.False(t, ok, "should not exist in Map")
-	_, ok = allTokens.all[tk2]
+	_, ok = peekMap(tk2)
 	assert.True(t, ok, "should exist in Map")
-	allTokens.lock.RUnlock()
 
 	// check redis TTL, should not be updated
 	conn := rdsPool.Get()
 	defer conn.Close()
 
-	ttl, err := redis.Int(conn.Do("TTL", tk))
+	ttl, err := redis.Int(conn.Do("TTL", tokenKey(tk)))
 	assert.NoError(t, err, "should not have error to get cache TTL")
 	assert.Equal(t, rdsLiveSecond-2, uint32(ttl), "TTL wrong")
 }
@@ -0,0 +1,233 @@
+package kktoken
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// the prefixes of the Redis keys counting failures and locking out clients
+const (
+	rdsFailPrefix = "kktoken:fail:"
+	rdsLockPrefix = "kktoken:lock:"
+)
+
+var (
+	// ErrLocked means the client failed too many times and is locked out.
+	ErrLocked = errors.New("client locked out")
+
+	// How many failed lookups of a client in the window to lock it out, 0 means disabled
+	rdsFailLimit uint32
+	// The seconds of the window counting failed lookups
+	rdsFailWindowSecond = uint32(60)
+	// The seconds to lock out a client
+	rdsLockoutSecond = uint32(300)
+
+	// count a failure, and lock out the client when reaching the limit
+	// KEYS: the failure counter, the lock; ARGV: window, limit, lockout
+	// return -1 if locked out, or the count
+	failScript = redis.NewScript(2, `local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('EXPIRE', KEYS[1], ARGV[1]) end
+if n >= tonumber(ARGV[2]) then
+	redis.call('SET', KEYS[2], 1, 'EX', ARGV[3])
+	redis.call('DEL', KEYS[1])
+	return -1
+end
+return n`)
+
+	// the lockouts known in this process, to not ask Redis on every lookup
+	allLocks = lockStore{
+		all:  make(map[string]lockState),
+		lock: new(sync.RWMutex),
+	}
+)
+
+// how long an identity known not locked is not asked again, another process might lock it out meanwhile
+const lockCheckInterval = time.Second
+
+// how many identities can be remembered in map
+const lockStoreSize = 10000
+
+// the lockout of an identity known until the time
+type lockState struct {
+	locked bool
+	until  int64
+}
+
+// the lockouts of identities known in this process
+type lockStore struct {
+	all  map[string]lockState
+	lock *sync.RWMutex
+}
+
+// get to get the lockout of an identity still known at the time.
+func (s *lockStore) get(key string, now int64) (lockState, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	state, ok := s.all[key]
+	return state, ok && state.until > now
+}
+
+// set to remember the lockout of an identity, a random one is forgotten if full.
+func (s *lockStore) set(key string, state lockState) {
+	s.lock.Lock()
+	if _, ok := s.all[key]; !ok && len(s.all) >= lockStoreSize {
+		for k := range s.all {
+			delete(s.all, k)
+			break
+		}
+	}
+	s.all[key] = state
+	s.lock.Unlock()
+}
+
+// forget to forget the lockouts of identities, like they are just unlocked.
+func (s *lockStore) forget(keys []string) {
+	s.lock.Lock()
+	for _, key := range keys {
+		delete(s.all, key)
+	}
+	s.lock.Unlock()
+}
+
+// purge to forget the lockouts known long enough.
+func (s *lockStore) purge(now int64) {
+	s.lock.Lock()
+	for key, state := range s.all {
+		if state.until <= now {
+			delete(s.all, key)
+		}
+	}
+	s.lock.Unlock()
+}
+
+// limitKeys to get the identities of the client to count failures, like "ip:10.0.0.1" and "id:app1".
+func limitKeys(client *Client) []string {
+	if client == nil {
+		return nil
+	}
+	var keys []string
+	if client.IP != nil {
+		keys = append(keys, "ip:"+client.IP.String())
+	}
+	if client.ID != "" {
+		keys = append(keys, "id:"+client.ID)
+	}
+	return keys
+}
+
+// checkLocked to check whether any identity of the client is locked out.
+// The lockouts are remembered in this process, Redis is only asked for the identities not known.
+func checkLocked(client *Client) error {
+	keys := limitKeys(client)
+	if rdsFailLimit == 0 || len(keys) == 0 {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	var unknown []string
+	for _, key := range keys {
+		state, ok := allLocks.get(key, now)
+		if !ok {
+			unknown = append(unknown, key)
+		} else if state.locked {
+			return ErrLocked
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	conn, err := rdsGet()
+	if err == errRedisOpen {
+		// not limited while Redis is skipped
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, key := range unknown {
+		conn.Send("PTTL", rdsLockPrefix+key)
+	}
+	ttls, err := redis.Int64s(conn.Do(""))
+	if err != nil {
+		return err
+	}
+
+	locked := false
+	for i, key := range unknown {
+		state := lockState{until: now + int64(lockCheckInterval)}
+		if ttls[i] > 0 {
+			state = lockState{locked: true, until: now + ttls[i]*int64(time.Millisecond)}
+		} else if ttls[i] == -1 {
+			// no expiration, ask again later
+			state.locked = true
+		}
+		allLocks.set(key, state)
+		locked = locked || state.locked
+	}
+	if locked {
+		return ErrLocked
+	}
+	return nil
+}
+
+// addFailure to count a failed lookup for all identities of the client.
+// EventLockout is sent when an identity is locked out.
+func addFailure(client *Client) error {
+	keys := limitKeys(client)
+	if rdsFailLimit == 0 || len(keys) == 0 {
+		return nil
+	}
+
+	conn, err := rdsGet()
+	if err == errRedisOpen {
+		// not limited while Redis is skipped
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, key := range keys {
+		n, err := redis.Int(failScript.Do(conn, rdsFailPrefix+key, rdsLockPrefix+key, rdsFailWindowSecond, rdsFailLimit, rdsLockoutSecond))
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			allLocks.set(key, lockState{
+				locked: true,
+				until:  time.Now().Add(time.Duration(rdsLockoutSecond) * time.Second).UnixNano(),
+			})
+			emit(Event{
+				Kind:   EventLockout,
+				Detail: key,
+			})
+		}
+	}
+	return nil
+}
+
+// Unlock to clear the failures and lockout of a client identity, like "ip:10.0.0.1" or "id:app1".
+// Other processes forget the lockout through the bus, or in a second without it.
+func Unlock(key string) error {
+	if !strings.HasPrefix(key, "ip:") && !strings.HasPrefix(key, "id:") {
+		return errors.New("key should start with ip: or id:")
+	}
+
+	conn, err := rdsGet()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Do("DEL", rdsFailPrefix+key, rdsLockPrefix+key); err != nil {
+		return err
+	}
+	allLocks.forget([]string{key})
+	return publish(busUnlock, key)
+}
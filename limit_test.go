@@ -0,0 +1,92 @@
+package kktoken
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func testFailLimit(t *testing.T) {
+	rdsFailLimit = 3
+	defer func() {
+		rdsFailLimit = 0
+	}()
+
+	var details []string
+	var lock sync.Mutex
+	SetObserver(func(e Event) {
+		if e.Kind == EventLockout {
+			lock.Lock()
+			details = append(details, e.Detail)
+			lock.Unlock()
+		}
+	})
+	defer SetObserver(nil)
+
+	userid := int32(38)
+	tk, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+
+	client := &Client{IP: net.ParseIP("10.9.8.7"), ID: "app1"}
+	assert.Nil(t, limitKeys(nil), "nil client has no keys")
+	assert.Equal(t, []string{"ip:10.9.8.7", "id:app1"}, limitKeys(client), "keys wrong")
+	for _, key := range limitKeys(client) {
+		assert.NoError(t, Unlock(key), "should not have error to unlock")
+	}
+
+	// guessing tokens
+	for i := 0; i < 2; i++ {
+		gotUserID, err := GetClientUserID(cleanToken(uuid.NewV4().String()), client)
+		assert.NoError(t, err, "should not have error before the limit")
+		assert.Equal(t, int32(0), gotUserID, "userid should be 0")
+	}
+	gotUserID, err := GetClientUserID(tk, client)
+	assert.NoError(t, err, "should not have error before the limit")
+	assert.Equal(t, userid, gotUserID, "userid wrong")
+	assert.Len(t, details, 0, "should not be locked out before the limit")
+
+	_, err = GetClientUserID("abc", client)
+	assert.NoError(t, err, "should not have error reaching the limit")
+	assert.Equal(t, []string{"ip:10.9.8.7", "id:app1"}, details, "both identities should be locked out")
+
+	_, err = GetClientUserID(tk, client)
+	assert.Equal(t, ErrLocked, err, "should be locked out")
+	_, err = GetClientUserID(tk, &Client{ID: "app1"})
+	assert.Equal(t, ErrLocked, err, "should be locked out by id")
+	_, err = GetClientUserID(tk, &Client{ID: "app2"})
+	assert.NoError(t, err, "other client should not be locked out")
+
+	// the lockout is remembered, and forgotten by the message of another process unlocking it
+	state, ok := allLocks.get("id:app1", time.Now().UnixNano())
+	assert.True(t, ok && state.locked, "the lockout should be remembered")
+	state, ok = allLocks.get("id:app2", time.Now().UnixNano())
+	assert.True(t, ok && !state.locked, "the identity not locked should be remembered")
+	assert.NoError(t, handleBusMessage(busUnlock+" id:app1"), "should not have error to handle the message")
+	_, ok = allLocks.get("id:app1", time.Now().UnixNano())
+	assert.False(t, ok, "the lockout should be forgotten")
+	_, err = GetClientUserID(tk, &Client{ID: "app1"})
+	assert.Equal(t, ErrLocked, err, "should be still locked out in Redis")
+
+	// the keys of the lockout are not tokens
+	for _, key := range []string{rdsLockPrefix + "ip:10.9.8.7", rdsFailPrefix + "id:app2", rdsSuspendKey} {
+		gotUserID, err = GetUserID(key)
+		assert.NoError(t, err, "should not have error to get a key")
+		assert.Equal(t, int32(0), gotUserID, "a key should not be a token")
+	}
+	_, err = GetUserID(tk)
+	assert.NoError(t, err, "should not limit without client")
+
+	assert.Error(t, Unlock("app1"), "should not unlock a wrong key")
+	for _, key := range limitKeys(client) {
+		assert.NoError(t, Unlock(key), "should not have error to unlock")
+	}
+	gotUserID, err = GetClientUserID(tk, client)
+	assert.NoError(t, err, "should not have error after unlocked")
+	assert.Equal(t, userid, gotUserID, "userid wrong")
+
+	assert.NoError(t, DelToken(tk), "should not have error to delete token")
+}
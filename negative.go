@@ -0,0 +1,73 @@
+package kktoken
+
+import (
+	"sync"
+	"time"
+)
+
+// the userid cached for a token known not to exist
+const missingUserID = int32(-1)
+
+// the tokens known not to exist, with when to forget them
+type missingStore struct {
+	all  map[string]int32
+	lock *sync.RWMutex
+}
+
+var (
+	// How many seconds a token not found will be remembered in map, 0 means disabled
+	mapNegativeSecond uint32
+	// How many tokens not found can be remembered in map
+	mapNegativeSize = uint32(10000)
+	// How many seconds a token not found will be remembered in redis, 0 means disabled
+	rdsNegativeSecond uint32
+
+	allMissing = missingStore{
+		all:  make(map[string]int32),
+		lock: new(sync.RWMutex),
+	}
+)
+
+// isMissing to check whether the token is known not to exist in map.
+func isMissing(tk string) bool {
+	allMissing.lock.RLock()
+	defer allMissing.lock.RUnlock()
+	until, ok := allMissing.all[tk]
+	return ok && int64(until) > time.Now().Unix()
+}
+
+// setMissing to remember the token not found in map, a random one is forgotten if full.
+func setMissing(tk string) {
+	if mapNegativeSecond == 0 || !isToken(tk) {
+		return
+	}
+	allMissing.lock.Lock()
+	if _, ok := allMissing.all[tk]; !ok && uint32(len(allMissing.all)) >= mapNegativeSize {
+		for k := range allMissing.all {
+			delete(allMissing.all, k)
+			break
+		}
+	}
+	allMissing.all[tk] = int32(time.Now().Unix() + int64(mapNegativeSecond))
+	allMissing.lock.Unlock()
+}
+
+// forgetMissing to forget the tokens not found before, like they are just made.
+func forgetMissing(tokens []string) {
+	allMissing.lock.Lock()
+	for _, tk := range tokens {
+		delete(allMissing.all, tk)
+	}
+	allMissing.lock.Unlock()
+}
+
+// purgeMissing to forget the tokens remembered long enough.
+func purgeMissing(now int64) {
+	allMissing.lock.Lock()
+	for tk, until := range allMissing.all {
+		if int64(until) <= now {
+			delete(allMissing.all, tk)
+		}
+	}
+	allMissing.lock.Unlock()
+}
@@ -0,0 +1,77 @@
+package kktoken
+
+import (
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func testNegativeCache(t *testing.T) {
+	mapNegativeSecond = 10
+	rdsNegativeSecond = 10
+	defer func() {
+		mapNegativeSecond = 0
+		rdsNegativeSecond = 0
+	}()
+
+	tk := cleanToken(uuid.NewV4().String())
+	gotUserID, err := GetUserID(tk)
+	assert.NoError(t, err, "should not have error to get a non-existed token")
+	assert.Equal(t, int32(0), gotUserID, "userid should be 0")
+	assert.True(t, isMissing(tk), "should be remembered in map")
+	got, err := getRedisCache(tk)
+	assert.NoError(t, err, "should not have error to get from redis")
+	assert.Equal(t, missingUserID, got.userid, "should be remembered in redis")
+
+	// remembered by redis only, like by another process
+	forgetMissing([]string{tk})
+	gotUserID, err = GetUserID(tk)
+	assert.NoError(t, err, "should not have error to get a non-existed token")
+	assert.Equal(t, int32(0), gotUserID, "userid should be 0")
+	assert.True(t, isMissing(tk), "should be remembered in map from redis")
+
+	// the token is made later
+	userid := int32(36)
+	now := int32(time.Now().Unix())
+	_, err = saveToken(&TokenInfo{Token: tk, UserID: userid, CreateAt: now, LastUse: now}, nil)
+	assert.NoError(t, err, "should not have error to save token")
+	assert.False(t, isMissing(tk), "should be forgotten when made")
+	evictMap([]string{tk})
+	gotUserID, err = GetUserID(tk)
+	assert.NoError(t, err, "should not have error to get token")
+	assert.Equal(t, userid, gotUserID, "should get the made token")
+
+	// made by another process
+	other := cleanToken(uuid.NewV4().String())
+	setMissing(other)
+	assert.NoError(t, handleBusMessage(busCreate+" "+other), "should not have error to handle message")
+	assert.False(t, isMissing(other), "should be forgotten when made by another process")
+
+	setMissing(other)
+	purgeMissing(time.Now().Unix() + 10)
+	assert.False(t, isMissing(other), "should be forgotten after purged")
+
+	// only tokens are remembered, not to overwrite other keys
+	gotUserID, err = GetUserID(rdsSuspendKey)
+	assert.NoError(t, err, "should not have error to get a key")
+	assert.Equal(t, int32(0), gotUserID, "a key should not be a token")
+	assert.False(t, isMissing(rdsSuspendKey), "a key should not be remembered")
+	assert.NoError(t, SuspendUser(userid), "suspended users should not be overwritten")
+	assert.NoError(t, ResumeUser(userid), "should not have error to resume user")
+
+	// the map is bounded
+	mapNegativeSize = 3
+	defer func() { mapNegativeSize = 10000 }()
+	purgeMissing(time.Now().Unix() + 10)
+	for i := 0; i < 5; i++ {
+		setMissing(cleanToken(uuid.NewV4().String()))
+	}
+	allMissing.lock.RLock()
+	assert.Len(t, allMissing.all, 3, "should not remember more than the size")
+	allMissing.lock.RUnlock()
+	purgeMissing(time.Now().Unix() + 10)
+
+	assert.NoError(t, DelToken(tk), "should not have error to delete token")
+}
@@ -0,0 +1,236 @@
+package kktoken
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// a background write waiting to be retried
+type retryEntry struct {
+	one tokenLatest
+	// how many times it failed
+	attempts uint32
+	// not retried before
+	nextAt time.Time
+}
+
+// the background writes waiting to be retried, by token
+type retryStore struct {
+	all map[string]*retryEntry
+	// the tokens taken by due and being written, true if dropped meanwhile
+	flight map[string]bool
+	lock   *sync.Mutex
+}
+
+func newRetryStore() retryStore {
+	return retryStore{
+		all:    make(map[string]*retryEntry),
+		flight: make(map[string]bool),
+		lock:   new(sync.Mutex),
+	}
+}
+
+var (
+	// How many times a background write is tried before given up
+	mapRetryLimit = uint32(5)
+	// The backoff before the first retry, doubled every retry
+	mapRetryBase = 500 * time.Millisecond
+	// The backoff is never longer than it
+	mapRetryMax = 60 * time.Second
+
+	// the usage not flushed to DB
+	dbRetry = newRetryStore()
+	// the tokens not refreshed in Redis
+	rdsRetry = newRetryStore()
+)
+
+// retryBackoff to get how long to wait after the given failures, with jitter to spread the retries.
+func retryBackoff(attempts uint32) time.Duration {
+	d := mapRetryBase
+	for i := uint32(1); i < attempts && d < mapRetryMax; i++ {
+		d *= 2
+	}
+	if d > mapRetryMax {
+		d = mapRetryMax
+	}
+	// somewhere between half and the whole backoff
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// failed to keep the write of token pending, the usage is merged into the pending one if any.
+func (s *retryStore) failed(token string, one tokenLatest, merge bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.all[token]
+	if !ok {
+		entry = &retryEntry{one: one}
+		s.all[token] = entry
+	} else if merge {
+		mergeUsage(&entry.one, one)
+	} else {
+		entry.one = one
+	}
+	entry.attempts++
+	entry.nextAt = time.Now().Add(retryBackoff(entry.attempts))
+}
+
+// forget the pending writes of the tokens.
+func (s *retryStore) forget(tokens []string) {
+	s.lock.Lock()
+	for _, token := range tokens {
+		delete(s.all, token)
+	}
+	s.lock.Unlock()
+}
+
+// drop the pending writes of the tokens revoked or changed, the ones being written are marked not to write back.
+func (s *retryStore) drop(tokens []string) {
+	s.lock.Lock()
+	for _, token := range tokens {
+		delete(s.all, token)
+		if _, ok := s.flight[token]; ok {
+			s.flight[token] = true
+		}
+	}
+	s.lock.Unlock()
+}
+
+// alive to get the writes taken by due and not dropped yet, the dropped ones are settled.
+func (s *retryStore) alive(tokens []string, entries []retryEntry) ([]string, []retryEntry) {
+	var aliveTokens []string
+	var aliveEntries []retryEntry
+
+	s.lock.Lock()
+	for i, token := range tokens {
+		if s.flight[token] {
+			delete(s.flight, token)
+			continue
+		}
+		aliveTokens = append(aliveTokens, token)
+		aliveEntries = append(aliveEntries, entries[i])
+	}
+	s.lock.Unlock()
+	return aliveTokens, aliveEntries
+}
+
+// settle to finish the writes taken by due, the tokens dropped while being written are returned.
+func (s *retryStore) settle(tokens []string) []string {
+	var dropped []string
+
+	s.lock.Lock()
+	for _, token := range tokens {
+		if s.flight[token] {
+			dropped = append(dropped, token)
+		}
+		delete(s.flight, token)
+	}
+	s.lock.Unlock()
+	return dropped
+}
+
+// due to take the writes to retry before now, all of them if now is zero.
+// The taken ones are being written until settle.
+func (s *retryStore) due(now time.Time) ([]string, []retryEntry) {
+	var tokens []string
+	var entries []retryEntry
+
+	s.lock.Lock()
+	for k, v := range s.all {
+		if now.IsZero() || !v.nextAt.After(now) {
+			tokens = append(tokens, k)
+			entries = append(entries, *v)
+			delete(s.all, k)
+			s.flight[k] = false
+		}
+	}
+	s.lock.Unlock()
+	return tokens, entries
+}
+
+// retry to keep the write taken by due pending again, false if it's tried mapRetryLimit times.
+// The write dropped since taken is not kept.
+func (s *retryStore) retry(token string, entry retryEntry, merge bool) bool {
+	entry.attempts++
+	if entry.attempts >= mapRetryLimit {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.flight[token] {
+		// dropped while being written
+		return true
+	}
+	if pending, ok := s.all[token]; ok {
+		// a later write failed meanwhile
+		if merge {
+			mergeUsage(&entry.one, pending.one)
+		} else {
+			entry.one = pending.one
+		}
+	}
+	entry.nextAt = time.Now().Add(retryBackoff(entry.attempts))
+	s.all[token] = &entry
+	return true
+}
+
+// giveUp to report the write not retried anymore, the entry is the one taken by due.
+func giveUp(token string, entry retryEntry, err error, tier string) {
+	emit(Event{
+		Kind:   EventRetryDrop,
+		Token:  token,
+		UserID: entry.one.userid,
+		Detail: tier,
+		Count:  int(entry.attempts) + 1,
+	})
+	sendError(err)
+}
+
+// retryWrites to retry the pending writes due before now.
+// If now is zero, all of them are tried for the last time.
+func retryWrites(now time.Time) {
+	last := now.IsZero()
+	tokens, entries := dbRetry.due(now)
+	latests := make([]tokenLatest, len(tokens))
+	for i := range entries {
+		latests[i] = entries[i].one
+	}
+	n, err := flushTokens(tokens, latests)
+	// the usage of a deleted token updates nothing
+	dbRetry.settle(tokens)
+	for i := n; i < len(tokens); i++ {
+		if last || !dbRetry.retry(tokens[i], entries[i], true) {
+			giveUp(tokens[i], entries[i], err, "postgres")
+		}
+	}
+
+	// the tokens revoked since taken are not cached again
+	tokens, entries = rdsRetry.alive(rdsRetry.due(now))
+	if len(tokens) == 0 {
+		return
+	}
+	latests = make([]tokenLatest, len(tokens))
+	for i := range entries {
+		latests[i] = entries[i].one
+	}
+	err = setRedisCache(tokens, latests)
+	if err != nil && err != errRedisOpen {
+		// when Redis is skipped, the tokens are loaded from DB again when it's back
+		for i := range tokens {
+			if last || !rdsRetry.retry(tokens[i], entries[i], false) {
+				giveUp(tokens[i], entries[i], err, "redis")
+			}
+		}
+	}
+	// the tokens revoked while caching are deleted again
+	if dropped := rdsRetry.settle(tokens); len(dropped) > 0 {
+		if err := delRedisCache(dropped...); err == errRedisOpen {
+			rdsPending.add(dropped...)
+		} else if err != nil {
+			sendError(err)
+		}
+	}
+}
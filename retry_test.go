@@ -0,0 +1,137 @@
+package kktoken
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRetryBackoff(t *testing.T) {
+	base, max := mapRetryBase, mapRetryMax
+	mapRetryBase, mapRetryMax = 100*time.Millisecond, time.Second
+	defer func() {
+		mapRetryBase, mapRetryMax = base, max
+	}()
+
+	for i := 0; i < 20; i++ {
+		d := retryBackoff(1)
+		assert.True(t, d >= 50*time.Millisecond && d <= 100*time.Millisecond, "first backoff wrong")
+		d = retryBackoff(3)
+		assert.True(t, d >= 200*time.Millisecond && d <= 400*time.Millisecond, "backoff should double")
+		d = retryBackoff(100)
+		assert.True(t, d >= 500*time.Millisecond && d <= time.Second, "backoff should be capped")
+	}
+}
+
+func testRetryWrites(t *testing.T) {
+	userid := int32(41)
+	tk, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+
+	// the failed updates are merged and retried after the backoff
+	now := int32(time.Now().Unix())
+	dbRetry.failed(tk, tokenLatest{userid: userid, lastUse: now + 100, uses: 2, firstUse: now}, true)
+	dbRetry.failed(tk, tokenLatest{userid: userid, lastUse: now + 50, uses: 1}, true)
+	dbRetry.lock.Lock()
+	entry := *dbRetry.all[tk]
+	dbRetry.lock.Unlock()
+	assert.Equal(t, uint32(2), entry.attempts, "attempts wrong")
+	assert.Equal(t, int64(3), entry.one.uses, "uses should be merged")
+
+	retryWrites(time.Now().Add(-time.Hour))
+	dbRetry.lock.Lock()
+	assert.Len(t, dbRetry.all, 1, "should wait for the backoff")
+	dbRetry.lock.Unlock()
+
+	retryWrites(entry.nextAt.Add(time.Second))
+	dbRetry.lock.Lock()
+	assert.Len(t, dbRetry.all, 0, "should be written")
+	dbRetry.lock.Unlock()
+	tokens, err := GetUserTokens(userid)
+	assert.NoError(t, err, "should not have error to get tokens")
+	assert.Len(t, tokens, 1, "should have one token")
+	assert.Equal(t, now+100, tokens[0].LastUse, "last_use should be retried")
+	assert.Equal(t, int64(3), tokens[0].UseCount, "use count should be retried")
+
+	// a refresh is not needed once refreshed
+	rdsRetry.failed(tk, entry.one, false)
+	rdsRetry.forget([]string{tk})
+	rdsRetry.lock.Lock()
+	assert.Len(t, rdsRetry.all, 0, "should be forgotten")
+	rdsRetry.lock.Unlock()
+
+	// given up after the limit
+	var drops []Event
+	SetObserver(func(e Event) {
+		if e.Kind == EventRetryDrop {
+			drops = append(drops, e)
+		}
+	})
+	defer SetObserver(nil)
+	entry.attempts = mapRetryLimit - 2
+	assert.True(t, dbRetry.retry(tk, entry, true), "should be kept under the limit")
+	taken, entries := dbRetry.due(time.Time{})
+	assert.Equal(t, []string{tk}, taken, "should be taken")
+	assert.False(t, dbRetry.retry(tk, entries[0], true), "should be given up at the limit")
+
+	failed := errors.New("failed")
+	got := make(chan error)
+	go func() {
+		got <- <-errChan
+	}()
+	giveUp(tk, entries[0], failed, "postgres")
+	assert.Equal(t, failed, <-got, "the error should be sent")
+	assert.Len(t, drops, 1, "should have a drop event")
+	assert.Equal(t, int(mapRetryLimit), drops[0].Count, "should be tried limit times")
+	assert.Equal(t, userid, drops[0].UserID, "userid wrong")
+
+	assert.NoError(t, DelToken(tk), "should not have error to delete token")
+}
+
+func testRetryRevoked(t *testing.T) {
+	userid := int32(45)
+	tk, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+	other, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+
+	// the refreshes failed before revoked
+	now := int32(time.Now().Unix())
+	for _, one := range []string{tk, other} {
+		rdsRetry.failed(one, tokenLatest{userid: userid, lastUse: now}, false)
+		dbRetry.failed(one, tokenLatest{userid: userid, lastUse: now, uses: 1}, true)
+	}
+	assert.NoError(t, DelToken(tk), "should not have error to delete token")
+	// revoked by another process
+	assert.NoError(t, handleBusMessage(busRevoke+" "+other), "should not have error to handle message")
+
+	for _, s := range []*retryStore{&rdsRetry, &dbRetry} {
+		s.lock.Lock()
+		assert.Len(t, s.all, 0, "the retries of revoked tokens should be dropped")
+		s.lock.Unlock()
+	}
+	retryWrites(time.Now().Add(time.Hour))
+	got, err := getRedisCache(tk)
+	assert.NoError(t, err, "should not have error to get from redis")
+	assert.Equal(t, int32(0), got.userid, "revoked token should not be cached again")
+
+	// revoked after taken to retry
+	s := newRetryStore()
+	s.failed(tk, tokenLatest{userid: userid, lastUse: now}, false)
+	s.failed(other, tokenLatest{userid: userid, lastUse: now}, false)
+	tokens, entries := s.due(time.Time{})
+	s.drop([]string{tk})
+	tokens, entries = s.alive(tokens, entries)
+	assert.Equal(t, []string{other}, tokens, "the dropped one should not be written")
+	assert.Len(t, entries, 1, "entries wrong")
+	// revoked while being written
+	s.drop([]string{other})
+	assert.True(t, s.retry(other, entries[0], false), "the dropped one should not be given up")
+	assert.Equal(t, []string{other}, s.settle(tokens), "the dropped one should be deleted again")
+	assert.Len(t, s.all, 0, "the dropped one should not be retried")
+	assert.Len(t, s.flight, 0, "all should be settled")
+
+	assert.NoError(t, DelToken(other), "should not have error to delete token")
+}
@@ -0,0 +1,37 @@
+package kktoken
+
+import "strings"
+
+// matchScope to check whether the granted scope covers the wanted one.
+// "*" covers everything, "orders:*" covers "orders" and everything under "orders:".
+func matchScope(granted, wanted string) bool {
+	if granted == wanted || granted == "*" {
+		return true
+	}
+
+	if !strings.HasSuffix(granted, ":*") {
+		return false
+	}
+	prefix := strings.TrimSuffix(granted, "*")
+	return wanted == strings.TrimSuffix(prefix, ":") || strings.HasPrefix(wanted, prefix)
+}
+
+// hasScope to check whether any of the granted scopes covers the wanted one.
+func hasScope(granted []string, wanted string) bool {
+	for _, one := range granted {
+		if matchScope(one, wanted) {
+			return true
+		}
+	}
+	return false
+}
+
+// coverScopes to check whether all the wanted scopes are covered by the granted ones.
+func coverScopes(granted, wanted []string) bool {
+	for _, one := range wanted {
+		if !hasScope(granted, one) {
+			return false
+		}
+	}
+	return true
+}
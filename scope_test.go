@@ -0,0 +1,27 @@
+package kktoken
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testScopes(t *testing.T) {
+	assert.True(t, matchScope("orders:read", "orders:read"), "exact scope should match")
+	assert.False(t, matchScope("orders:read", "orders:write"), "different scope should not match")
+	assert.True(t, matchScope("*", "orders:read"), "* should match everything")
+	assert.True(t, matchScope("orders:*", "orders:read"), "wildcard should match child")
+	assert.True(t, matchScope("orders:*", "orders:items:write"), "wildcard should match descendant")
+	assert.True(t, matchScope("orders:*", "orders"), "wildcard should match itself")
+	assert.False(t, matchScope("orders:*", "ordersx"), "wildcard should not match sibling")
+	assert.False(t, matchScope("orders:read", "orders:*"), "narrow scope should not match wildcard")
+
+	granted := []string{"orders:*", "profile:read"}
+	assert.True(t, hasScope(granted, "profile:read"), "should have scope")
+	assert.False(t, hasScope(granted, "profile:write"), "should not have scope")
+	assert.False(t, hasScope(nil, "profile:read"), "should not have scope")
+
+	assert.True(t, coverScopes(granted, []string{"orders:read", "profile:read"}), "should cover scopes")
+	assert.False(t, coverScopes(granted, []string{"orders:read", "admin"}), "should not cover scopes")
+	assert.True(t, coverScopes(granted, nil), "should cover empty scopes")
+}
@@ -0,0 +1,154 @@
+package kktoken
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// TokenState the state of a token.
+type TokenState string
+
+const (
+	// StateValid means the token can be used.
+	StateValid TokenState = "valid"
+	// StateUnknown means the token never existed, or its tombstone is gone.
+	StateUnknown TokenState = "unknown"
+	// StateExpiredIdle means the token is not used for DBInfo.PersistentSecond.
+	StateExpiredIdle TokenState = "expired_idle"
+	// StateExpiredAbsolute means the token reached its TokenOptions.LiveSecond.
+	StateExpiredAbsolute TokenState = "expired_absolute"
+	// StateRevoked means the token is deleted by the caller.
+	StateRevoked TokenState = "revoked"
+	// StateSuspended means the user of the token is suspended.
+	StateSuspended TokenState = "suspended"
+	// StateMismatch means the client doesn't match the binding of the token.
+	StateMismatch TokenState = "binding_mismatch"
+)
+
+// TokenStatus why a token is valid or not.
+type TokenStatus struct {
+	State  TokenState
+	UserID int32
+	// the reason given to RevokeToken
+	Reason string
+	// when the token became invalid, 0 if not known
+	At int32
+}
+
+var (
+	dbTombstoneSecond  uint32
+	insertTombstoneStm string
+	queryTombstoneStm  string
+	purgeTombstoneStm  string
+	queryInvalidStm    string
+)
+
+// prepareTombstone to create the tombstone table and statements.
+func prepareTombstone(tableName string, seconds uint32) error {
+	s := `CREATE TABLE IF NOT EXISTS %s_tombstone (
+	token UUID PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	state TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	remove_at INTEGER NOT NULL);`
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName)); err != nil {
+		return err
+	}
+
+	// create index if not exist for remove_at to purge tombstones
+	s = "CREATE INDEX IF NOT EXISTS %s_tombstone_remove_at_index ON %s_tombstone USING btree (remove_at);"
+	if _, err := dbPool.Exec(fmt.Sprintf(s, tableName, tableName)); err != nil {
+		return err
+	}
+
+	insertTombstoneStm = fmt.Sprintf(`INSERT INTO %s_tombstone(token,user_id,state,reason,remove_at)
+	SELECT tk::uuid,u,st,r,$5 FROM unnest($1::text[],$2::integer[],$3::text[],$4::text[]) AS t(tk,u,st,r)
+	ON CONFLICT (token) DO NOTHING`, tableName)
+	queryTombstoneStm = fmt.Sprintf("SELECT user_id,state,reason,remove_at FROM %s_tombstone WHERE token=$1", tableName)
+	purgeTombstoneStm = fmt.Sprintf("DELETE FROM %s_tombstone WHERE remove_at < $1", tableName)
+	queryInvalidStm = fmt.Sprintf("SELECT user_id,last_use,expire_at FROM %s WHERE token=$1", tableName)
+	dbTombstoneSecond = seconds
+	return nil
+}
+
+// addTombstones to record the removed tokens, the states and reasons can be a single one for all.
+// Nothing happens if tombstone is not enabled.
+func addTombstones(db dbRunner, tokens []string, userids []int32, states []string, reasons []string) error {
+	if dbTombstoneSecond == 0 || len(tokens) == 0 {
+		return nil
+	}
+
+	l := len(tokens)
+	if l != len(userids) || (len(states) != l && len(states) != 1) || (len(reasons) != l && len(reasons) != 1) {
+		return errors.New("parameters wrong for tombstone batch add")
+	}
+
+	_, err := db.Exec(insertTombstoneStm, tokens, userids, fillStrings(states, l), fillStrings(reasons, l), time.Now().Unix())
+	return err
+}
+
+// purgeTombstones to delete the tombstones older than the retention.
+func purgeTombstones(db dbRunner, now int64) error {
+	if dbTombstoneSecond == 0 {
+		return nil
+	}
+	_, err := db.Exec(purgeTombstoneStm, now-int64(dbTombstoneSecond))
+	return err
+}
+
+// explainToken to get why a token is not found in DB with getUserID.
+func explainToken(token string) (TokenStatus, error) {
+	var status TokenStatus
+	var lastUse, expireAt int32
+
+	// the record is still there but expired
+	err := dbPool.QueryRow(queryInvalidStm, token).Scan(&status.UserID, &lastUse, &expireAt)
+	if isInvalidUUID(err) {
+		return TokenStatus{State: StateUnknown}, nil
+	}
+	if err == nil {
+		if expireAt > 0 && int64(expireAt) <= time.Now().Unix() {
+			status.State = StateExpiredAbsolute
+			status.At = expireAt
+		} else if dbPersistentSecond > 0 && int64(lastUse)+int64(dbPersistentSecond) <= time.Now().Unix() {
+			status.State = StateExpiredIdle
+			status.At = lastUse + int32(dbPersistentSecond)
+		} else {
+			// just made
+			status.State = StateValid
+		}
+		return status, nil
+	}
+	if err != pgx.ErrNoRows {
+		return TokenStatus{}, err
+	}
+
+	if dbTombstoneSecond == 0 {
+		return TokenStatus{State: StateUnknown}, nil
+	}
+	var state string
+	err = dbPool.QueryRow(queryTombstoneStm, token).Scan(&status.UserID, &state, &status.Reason, &status.At)
+	if err == pgx.ErrNoRows {
+		return TokenStatus{State: StateUnknown}, nil
+	}
+	if err != nil {
+		return TokenStatus{}, err
+	}
+	status.State = TokenState(state)
+	return status, nil
+}
+
+// fillStrings to repeat a single value n times, or return the values as it is.
+func fillStrings(values []string, n int) []string {
+	if len(values) == n {
+		return values
+	}
+	all := make([]string, n)
+	for i := range all {
+		all[i] = values[0]
+	}
+	return all
+}
@@ -0,0 +1,98 @@
+package kktoken
+
+import (
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func testTombstone(t *testing.T) {
+	err := prepareTombstone(testTableName, 100)
+	assert.NoError(t, err, "should not have error to prepare tombstone")
+	defer func() {
+		dbTombstoneSecond = 0
+	}()
+	testTableGeneration(testTableName+"_tombstone", t)
+
+	userid := int32(33)
+	tk, err := MakeToken(userid, nil)
+	assert.NoError(t, err, "should not have error to make token")
+
+	before, _ := peekMap(tk)
+	status, err := CheckToken(tk, nil)
+	assert.NoError(t, err, "should not have error to check token")
+	assert.Equal(t, TokenStatus{State: StateValid, UserID: userid}, status, "status wrong")
+	after, _ := peekMap(tk)
+	assert.Equal(t, before.uses, after.uses, "checking should not be a use")
+
+	// not loaded to map by checking
+	evictMap([]string{tk})
+	status, err = CheckToken(tk, nil)
+	assert.NoError(t, err, "should not have error to check token")
+	assert.Equal(t, StateValid, status.State, "state wrong")
+	_, ok := peekMap(tk)
+	assert.False(t, ok, "checking should not load the token to map")
+
+	// never existed
+	status, err = CheckToken(uuid.NewV4().String(), nil)
+	assert.NoError(t, err, "should not have error to check token")
+	assert.Equal(t, StateUnknown, status.State, "state wrong")
+	status, err = CheckToken("abc", nil)
+	assert.NoError(t, err, "should not have error to check token")
+	assert.Equal(t, StateUnknown, status.State, "state wrong")
+
+	// suspended
+	err = SuspendUser(userid)
+	assert.NoError(t, err, "should not have error to suspend user")
+	status, err = CheckToken(tk, nil)
+	assert.NoError(t, err, "should not have error to check token")
+	assert.Equal(t, StateSuspended, status.State, "state wrong")
+	err = ResumeUser(userid)
+	assert.NoError(t, err, "should not have error to resume user")
+
+	// expired by absolute expiration, while still in DB
+	child, err := MakeChildToken(tk, nil, &TokenOptions{LiveSecond: 1})
+	assert.NoError(t, err, "should not have error to make child token")
+	time.Sleep(1100 * time.Millisecond)
+	status, err = CheckToken(child, nil)
+	assert.NoError(t, err, "should not have error to check token")
+	assert.Equal(t, StateExpiredAbsolute, status.State, "state wrong")
+	assert.Equal(t, userid, status.UserID, "userid wrong")
+
+	// revoked with reason, also the child
+	err = RevokeToken(tk, "password_changed", nil)
+	assert.NoError(t, err, "should not have error to revoke token")
+	status, err = CheckToken(tk, nil)
+	assert.NoError(t, err, "should not have error to check token")
+	assert.Equal(t, StateRevoked, status.State, "state wrong")
+	assert.Equal(t, "password_changed", status.Reason, "reason wrong")
+	assert.Equal(t, userid, status.UserID, "userid wrong")
+	status, err = CheckToken(child, nil)
+	assert.NoError(t, err, "should not have error to check token")
+	assert.Equal(t, StateRevoked, status.State, "child state wrong")
+
+	// expired by EXPCheck
+	now := time.Now().Unix()
+	tkInfo := &TokenInfo{
+		Token:    uuid.NewV4().String(),
+		UserID:   userid,
+		CreateAt: int32(now - 10),
+		LastUse:  int32(now - 10),
+	}
+	err = setToken(tkInfo)
+	assert.NoError(t, err, "should not have error to set token")
+	_, err = delExpired(dbPool, delExpiredSQL(testTableName), now-5, now)
+	assert.NoError(t, err, "should not have error to delete expired tokens")
+	status, err = CheckToken(tkInfo.Token, nil)
+	assert.NoError(t, err, "should not have error to check token")
+	assert.Equal(t, StateExpiredIdle, status.State, "state wrong")
+
+	// purge after retention
+	err = purgeTombstones(dbPool, now+200)
+	assert.NoError(t, err, "should not have error to purge tombstones")
+	status, err = CheckToken(tk, nil)
+	assert.NoError(t, err, "should not have error to check token")
+	assert.Equal(t, StateUnknown, status.State, "state wrong after purged")
+}